@@ -0,0 +1,355 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bundleFile is a file Install would write.
+type bundleFile struct {
+	path         string // Absolute target path.
+	mode         os.FileMode
+	owner, group string // Empty leaves the owner or group of the installing user.
+	data         []byte
+}
+
+// bundler is implemented by services that can list what Install does.
+type bundler interface {
+	bundle() (files []bundleFile, commands [][]string, err error)
+}
+
+// bundleManifestName is the first entry of a bundle.
+const bundleManifestName = "MANIFEST.json"
+
+// bundleManifest lists the files of a bundle, by target path, and the
+// commands InstallBundle runs once they are written.
+type bundleManifest struct {
+	Name     string     `json:"name"`
+	Files    []string   `json:"files"`
+	Commands [][]string `json:"commands"`
+}
+
+// bundleCommands are the programs of the commands undoBundleCommand allows.
+// A command whose program maps to a func runs only if that func reports the
+// host needs it.
+var bundleCommands = map[string]func() bool{
+	"systemctl":       nil,
+	"apparmor_parser": appArmorEnabled,
+}
+
+// bundleDirs are the directories, relative to the root, that bundle files
+// may be written to: the system unit directory, the init scripts of AlsoSysV
+// and the AppArmor profiles.
+var bundleDirs = map[string]bool{
+	bundleUnitDir:     true,
+	"etc/init.d":      true,
+	bundleAppArmorDir: true,
+}
+
+// The directories of bundleDirs that bundle commands refer to.
+const (
+	bundleUnitDir     = "etc/systemd/system"
+	bundleAppArmorDir = "etc/apparmor.d"
+)
+
+// appArmorEnabledFile reads Y if the kernel has AppArmor enabled.
+var appArmorEnabledFile = "/sys/module/apparmor/parameters/enabled"
+
+// appArmorEnabled reports whether the kernel has AppArmor enabled.
+func appArmorEnabled() bool {
+	b, err := ioutil.ReadFile(appArmorEnabledFile)
+	return err == nil && strings.TrimSpace(string(b)) == "Y"
+}
+
+// Bundle writes a tar archive of every file Install would write, each at
+// its target path without the leading "/", after a MANIFEST.json entry
+// that lists the files and the commands, such as systemctl enable, that
+// Install would run. The archive can be reviewed or signed, then applied
+// on another host with InstallBundle, which loads an AppArmor profile only
+// if that host has AppArmor enabled. An absolute Executable is used as
+// given, as it need not exist on this host. Only systemd system services
+// are supported.
+func Bundle(s Service, w io.Writer) error {
+	b, ok := s.(bundler)
+	if !ok {
+		return ErrNotSupported
+	}
+	files, commands, err := b.bundle()
+	if err != nil {
+		return err
+	}
+	m := bundleManifest{Name: s.String(), Commands: commands}
+	for _, f := range files {
+		m.Files = append(m.Files, f.path)
+	}
+	manifest, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	entries := append([]bundleFile{{path: "/" + bundleManifestName, mode: 0644, data: append(manifest, '\n')}}, files...)
+	for _, f := range entries {
+		hdr := &tar.Header{
+			Name:    strings.TrimPrefix(f.path, "/"),
+			Mode:    int64(f.mode.Perm()),
+			Size:    int64(len(f.data)),
+			Uname:   f.owner,
+			Gname:   f.group,
+			ModTime: now,
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err = tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// InstallBundle applies a bundle written by Bundle: it writes the files,
+// which must not exist yet, and then runs the commands of the manifest.
+// Only the commands Bundle writes for the files of the bundle are allowed.
+// Nothing is written unless the whole bundle is valid, and if writing a file
+// or running a command fails, the commands that ran are undone and the
+// files removed again. Files
+// may only be written to the directories the systemd backend uses, none of
+// which may be a symbolic link.
+func InstallBundle(r io.Reader) error {
+	return installBundle(r, "/")
+}
+
+// pending is a bundle file to write, with the IDs of its owner and group.
+type pending struct {
+	bundleFile
+	uid, gid int
+}
+
+// installBundle is InstallBundle with the files written below root.
+func installBundle(r io.Reader, root string) error {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("Invalid bundle: %v", err)
+	}
+	if hdr.Name != bundleManifestName {
+		return fmt.Errorf("Invalid bundle: first entry is %q, not %s.", hdr.Name, bundleManifestName)
+	}
+	var m bundleManifest
+	if err = json.NewDecoder(tr).Decode(&m); err != nil {
+		return fmt.Errorf("Invalid bundle manifest: %v", err)
+	}
+	listed := make(map[string]bool, len(m.Files))
+	for _, p := range m.Files {
+		listed[strings.TrimPrefix(p, "/")] = true
+	}
+	undo := make([][]string, len(m.Commands))
+	for i, argv := range m.Commands {
+		if undo[i], err = undoBundleCommand(listed, argv); err != nil {
+			return err
+		}
+	}
+
+	var files []pending
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid bundle: %v", err)
+		}
+		name := hdr.Name
+		if hdr.Typeflag != tar.TypeReg || path.Clean(name) != name || !listed[name] {
+			return fmt.Errorf("Bundle entry %q is not a file of the manifest.", name)
+		}
+		if !bundleDirs[path.Dir(name)] {
+			return fmt.Errorf("Bundle entry %q is outside the service directories.", name)
+		}
+		delete(listed, name)
+		target := filepath.Join(root, filepath.FromSlash(name))
+		if err = checkBundleDir(root, path.Dir(name)); err != nil {
+			return err
+		}
+		if _, err = os.Lstat(target); err == nil {
+			return fmt.Errorf("Bundle file already exists: %s", target)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		uid, gid, err := lookupOwner(hdr.Uname, hdr.Gname)
+		if err != nil {
+			return err
+		}
+		files = append(files, pending{bundleFile{target, os.FileMode(hdr.Mode).Perm(), hdr.Uname, hdr.Gname, data}, uid, gid})
+	}
+	if len(listed) != 0 {
+		missing := make([]string, 0, len(listed))
+		for name := range listed {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("Bundle is missing %s.", strings.Join(missing, ", "))
+	}
+
+	return applyBundle(files, m.Commands, undo)
+}
+
+// applyBundle writes files and then runs commands. If that fails, it runs
+// the undo commands of those that ran, in reverse, and removes the files.
+func applyBundle(files []pending, commands, undo [][]string) (err error) {
+	var written []string
+	var ran [][]string
+	defer func() {
+		if err == nil {
+			return
+		}
+		var rollbackErr error
+		for i := len(ran) - 1; i >= 0; i-- {
+			if _, uerr := runCommand(ran[i][0], ran[i][1:]...); uerr != nil && rollbackErr == nil {
+				rollbackErr = uerr
+			}
+		}
+		for _, p := range written {
+			if rerr := os.Remove(p); rerr != nil && rollbackErr == nil {
+				rollbackErr = rerr
+			}
+		}
+		if rollbackErr != nil {
+			err = fmt.Errorf("%v; rollback failed: %v", err, rollbackErr)
+		}
+	}()
+	for _, f := range files {
+		if err = writeBundleFile(f.bundleFile, f.uid, f.gid); err != nil {
+			return err
+		}
+		written = append(written, f.path)
+	}
+	for i, argv := range commands {
+		if needed := bundleCommands[argv[0]]; needed != nil && !needed() {
+			continue
+		}
+		if _, err = runCommand(argv[0], argv[1:]...); err != nil {
+			return err
+		}
+		if undo[i] != nil {
+			ran = append(ran, undo[i])
+		}
+	}
+	return nil
+}
+
+// undoBundleCommand fails unless argv is a command Bundle writes for the
+// files listed, and returns the command that undoes it, or nil if there is
+// none. Only systemctl daemon-reload, enable or mask --runtime of a listed
+// .service unit and apparmor_parser -r of a listed profile are allowed.
+func undoBundleCommand(listed map[string]bool, argv []string) ([]string, error) {
+	unit := func(name string) bool {
+		return strings.HasSuffix(name, ".service") && path.Base(name) == name &&
+			listed[path.Join(bundleUnitDir, name)]
+	}
+	switch {
+	case len(argv) == 2 && argv[0] == "systemctl" && argv[1] == "daemon-reload":
+		return nil, nil
+	case len(argv) == 3 && argv[0] == "systemctl" && argv[1] == "enable" && unit(argv[2]):
+		return []string{"systemctl", "disable", argv[2]}, nil
+	case len(argv) == 4 && argv[0] == "systemctl" && argv[1] == "mask" && argv[2] == "--runtime" && unit(argv[3]):
+		return []string{"systemctl", "unmask", "--runtime", argv[3]}, nil
+	case len(argv) == 3 && argv[0] == "apparmor_parser" && argv[1] == "-r" &&
+		path.Dir(argv[2]) == "/"+bundleAppArmorDir && listed[strings.TrimPrefix(argv[2], "/")]:
+		return []string{"apparmor_parser", "-R", argv[2]}, nil
+	}
+	return nil, fmt.Errorf("Bundle command %q is not allowed.", argv)
+}
+
+// checkBundleDir fails if dir, or one of its parents below root, is a
+// symbolic link or not a directory. Missing directories are created later.
+func checkBundleDir(root, dir string) error {
+	p := root
+	for _, elem := range strings.Split(dir, "/") {
+		p = filepath.Join(p, elem)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Bundle directory %s is a symbolic link.", p)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("Bundle directory %s is not a directory.", p)
+		}
+	}
+	return nil
+}
+
+// lookupOwner returns the IDs of the owner and group of a bundle file, or
+// -1 for those that are empty.
+func lookupOwner(owner, group string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if len(owner) != 0 {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if len(group) != 0 {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// writeBundleFile creates f, removing it again if it cannot be written.
+func writeBundleFile(f bundleFile, uid, gid int) (err error) {
+	if err = os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	// O_EXCL also refuses a symbolic link created since the bundle was checked.
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, f.mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(f.path)
+		}
+	}()
+	// OpenFile applies the umask to a new file.
+	if err = file.Chmod(f.mode); err != nil {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		if err = file.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+	if _, err = file.Write(f.data); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// CommandRunner runs the service manager commands, such as systemctl and
+// launchctl, that services call. Set one with SetCommandRunner to record or
+// stub the commands in tests.
+type CommandRunner interface {
+	// Run runs the named command and returns its standard output. A command
+	// that exits with a non-zero status returns an error.
+	Run(ctx context.Context, name string, args ...string) (stdout string, err error)
+}
+
+var (
+	commandRunnerLock sync.RWMutex
+	commandRunner     CommandRunner = execRunner{}
+)
+
+// SetCommandRunner replaces the CommandRunner used by all services. A nil
+// r restores the default, which runs the commands with os/exec.
+func SetCommandRunner(r CommandRunner) {
+	if r == nil {
+		r = execRunner{}
+	}
+	commandRunnerLock.Lock()
+	commandRunner = r
+	commandRunnerLock.Unlock()
+}
+
+// runCommand runs name with the current CommandRunner.
+func runCommand(name string, args ...string) (string, error) {
+	return runCommandContext(context.Background(), name, args...)
+}
+
+// runCommandContext is runCommand with a context that can end the command.
+func runCommandContext(ctx context.Context, name string, args ...string) (string, error) {
+	commandRunnerLock.RLock()
+	r := commandRunner
+	commandRunnerLock.RUnlock()
+	return r.Run(ctx, name, args...)
+}
+
+// combinedRunner is implemented by a CommandRunner that can also return the
+// standard output and error of a command together.
+type combinedRunner interface {
+	RunCombined(ctx context.Context, name string, args ...string) (output string, err error)
+}
+
+// runCombined runs name with the current CommandRunner and returns its
+// standard output and error together, or only its standard output if the
+// runner is not a combinedRunner.
+func runCombined(name string, args ...string) (string, error) {
+	commandRunnerLock.RLock()
+	r := commandRunner
+	commandRunnerLock.RUnlock()
+	if c, ok := r.(combinedRunner); ok {
+		return c.RunCombined(context.Background(), name, args...)
+	}
+	return r.Run(context.Background(), name, args...)
+}
+
+// launchctlControlVerbs are the launchctl verbs whose failures are reported
+// only on stderr. Queries such as list and print may warn there and succeed.
+var launchctlControlVerbs = map[string]bool{
+	"load":      true,
+	"unload":    true,
+	"start":     true,
+	"stop":      true,
+	"bootstrap": true,
+	"bootout":   true,
+	"kickstart": true,
+}
+
+// execRunner is the default CommandRunner.
+type execRunner struct{}
+
+func (execRunner) Run(ctx context.Context, name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); len(msg) != 0 {
+			return stdout.String(), fmt.Errorf("%q failed: %v: %s", name, err, msg)
+		}
+		return stdout.String(), fmt.Errorf("%q failed: %v", name, err)
+	}
+	// Darwin: launchctl can fail with a zero exit status,
+	// so check for emtpy stderr
+	if name == "launchctl" && len(args) != 0 && launchctlControlVerbs[args[0]] && stderr.Len() > 0 {
+		return stdout.String(), fmt.Errorf("%q failed with stderr: %s", name, stderr.Bytes())
+	}
+	return stdout.String(), nil
+}
+
+func (execRunner) RunCombined(ctx context.Context, name string, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("%q failed: %v", name, err)
+	}
+	return string(out), nil
+}
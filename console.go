@@ -5,8 +5,12 @@
 package service
 
 import (
+	"bufio"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"sync"
 )
 
 // ConsoleLogger logs to the std err.
@@ -46,3 +50,73 @@ func (c consoleLogger) Infof(format string, a ...interface{}) error {
 	c.info.Printf(format, a...)
 	return nil
 }
+
+// redirectOutput sends the standard output and error of the process to the
+// Logger of s if the CaptureStderr option is set. The returned function
+// restores the originals.
+func redirectOutput(s Service, c *Config) (restore func()) {
+	restore = func() {}
+	if !c.Option.bool(optionCaptureStderr, optionCaptureStderrDefault) {
+		return
+	}
+	l, err := s.Logger(nil)
+	if err != nil {
+		return
+	}
+	// Interactive output already reaches the console, and ConsoleLogger
+	// writing to the captured stderr would read back its own lines.
+	if l == Logger(ConsoleLogger) {
+		return
+	}
+	r, err := captureOutput(l)
+	if err != nil {
+		l.Warningf("Failed to capture output: %v", err)
+		return
+	}
+	return r
+}
+
+// captureOutput points the standard output and error of the process at pipes
+// with redirectStd and writes each line read from them to l until restore is
+// called. l must not write to the standard error itself.
+func captureOutput(l Logger) (restore func(), err error) {
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		outR.Close()
+		outW.Close()
+		return nil, err
+	}
+	restoreStd, err := redirectStd(outW, errW)
+	if err != nil {
+		for _, f := range []*os.File{outR, outW, errR, errW} {
+			f.Close()
+		}
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go logLines(&wg, outR, l.Info)
+	go logLines(&wg, errR, l.Error)
+	return func() {
+		restoreStd()
+		outW.Close()
+		errW.Close()
+		wg.Wait()
+	}, nil
+}
+
+func logLines(wg *sync.WaitGroup, r io.ReadCloser, logf func(v ...interface{}) error) {
+	defer wg.Done()
+	defer r.Close()
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		logf(sc.Text())
+	}
+	// Keep draining after a scan error so writers never block on a full pipe.
+	io.Copy(ioutil.Discard, r)
+}
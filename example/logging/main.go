@@ -8,6 +8,7 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
 	"time"
 
 	"github.com/kardianos/service"
@@ -100,5 +101,7 @@ func main() {
 	err = s.Run()
 	if err != nil {
 		logger.Error(err)
+		// Exit non-zero so the service manager sees a failure and can restart it.
+		os.Exit(1)
 	}
 }
@@ -190,5 +190,7 @@ func main() {
 	err = s.Run()
 	if err != nil {
 		logger.Error(err)
+		// Exit non-zero so the service manager sees a failure and can restart it.
+		os.Exit(1)
 	}
 }
@@ -7,6 +7,7 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/kardianos/service"
 )
@@ -47,5 +48,7 @@ func main() {
 	err = s.Run()
 	if err != nil {
 		logger.Error(err)
+		// Exit non-zero so the service manager sees a failure and can restart it.
+		os.Exit(1)
 	}
 }
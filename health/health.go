@@ -0,0 +1,117 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+// Package health serves liveness and readiness endpoints for a program
+// built with package service:
+//
+//	/healthz  200 while the process runs
+//	/readyz   200 while the program is ready, 503 otherwise
+//
+// Readiness follows SetReady and the optional Check function, and turns
+// false once Run starts stopping the program when StateChange is set as
+// the OnStateChange option:
+//
+//	hs := health.NewHealthServer(":8081")
+//	c.Option = service.KeyValue{"OnStateChange": hs.StateChange}
+//
+// It is a separate package so programs that do not use it do not link
+// net/http.
+package health // import "github.com/kardianos/service/health"
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/kardianos/service"
+)
+
+// Server serves the health endpoints. It is also an http.Handler, so the
+// endpoints can be added to an existing mux instead of calling Start.
+type Server struct {
+	// Check, if set, is called by each readiness probe while the program
+	// is ready otherwise. An error makes the probe fail with its text. Set
+	// it before serving probes.
+	Check func() error
+
+	mu       sync.Mutex
+	ready    bool
+	stopping bool
+	srv      *http.Server
+}
+
+// NewHealthServer returns a Server that Start serves on addr, such as
+// ":8081". The program is not ready until SetReady(true).
+func NewHealthServer(addr string) *Server {
+	s := &Server{}
+	s.srv = &http.Server{Addr: addr, Handler: s}
+	return s
+}
+
+// SetReady sets whether the program is ready to receive work, typically
+// at the end of Start.
+func (s *Server) SetReady(ready bool) {
+	s.mu.Lock()
+	s.ready = ready
+	s.mu.Unlock()
+}
+
+// StateChange has the signature of the OnStateChange option. From
+// StateStopping on, through Drain and Stop, the program is not ready
+// regardless of SetReady.
+func (s *Server) StateChange(from, to service.State) {
+	s.mu.Lock()
+	s.stopping = to == service.StateStopping || to == service.StateStopped
+	s.mu.Unlock()
+}
+
+// Ready reports whether a readiness probe would succeed, and if not why.
+func (s *Server) Ready() error {
+	s.mu.Lock()
+	ready := s.ready && !s.stopping
+	s.mu.Unlock()
+	if !ready {
+		return errNotReady
+	}
+	if s.Check != nil {
+		return s.Check()
+	}
+	return nil
+}
+
+var errNotReady = errors.New("Not ready.")
+
+// ServeHTTP serves /healthz and /readyz and answers 404 to other paths.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+		w.Write([]byte("ok\n"))
+	case "/readyz":
+		if err := s.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Start listens on the address of the server and serves in the
+// background. A failure to listen is returned.
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return err
+	}
+	go s.srv.Serve(l)
+	return nil
+}
+
+// Shutdown stops the server, waiting for active probes until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
@@ -0,0 +1,48 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kardianos/service"
+)
+
+func probe(s *Server, path string) int {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec.Code
+}
+
+func TestServer(t *testing.T) {
+	s := NewHealthServer("127.0.0.1:0")
+	if code := probe(s, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %d", code)
+	}
+	steps := []struct {
+		name string
+		do   func()
+		want int
+	}{
+		{"initial", func() {}, http.StatusServiceUnavailable},
+		{"SetReady", func() { s.SetReady(true) }, http.StatusOK},
+		{"failing Check", func() { s.Check = func() error { return errors.New("no db") } }, http.StatusServiceUnavailable},
+		{"passing Check", func() { s.Check = func() error { return nil } }, http.StatusOK},
+		{"stopping", func() { s.StateChange(service.StateRunning, service.StateStopping) }, http.StatusServiceUnavailable},
+		{"started again", func() { s.StateChange(service.StateStopped, service.StateRunning) }, http.StatusOK},
+	}
+	for _, step := range steps {
+		step.do()
+		if code := probe(s, "/readyz"); code != step.want {
+			t.Errorf("%s: /readyz = %d, want %d", step.name, code, step.want)
+		}
+	}
+	if code := probe(s, "/other"); code != http.StatusNotFound {
+		t.Errorf("/other = %d", code)
+	}
+}
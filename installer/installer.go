@@ -0,0 +1,147 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+// Package installer writes scripts that install a program built with
+// package service. The scripts copy the program into place, gain the rights
+// needed and run the program with its service control flag, such as
+//
+//	myd -service install
+//	myd -service start
+//
+// The program must pass the flag value to service.Control.
+package installer // import "github.com/kardianos/service/installer"
+
+import (
+	"io"
+	"strings"
+	"text/template"
+
+	"github.com/kardianos/service"
+)
+
+// Script describes the install script of a program.
+type Script struct {
+	// Config is the service configuration of the program. Its Name is
+	// used for defaults and its Executable, if set, is the install target.
+	Config *service.Config
+
+	// Binary is the file name of the program, in the directory of the
+	// script. Defaults to Config.Name, with ".exe" for PowerShell.
+	Binary string
+
+	// ControlFlag is the flag the program reads service.Control actions
+	// from. Defaults to "-service".
+	ControlFlag string
+
+	// Actions are passed to ControlFlag in order. Defaults to install
+	// then start.
+	Actions []string
+}
+
+type scriptData struct {
+	Name        string
+	Platform    string
+	Binary      string
+	Target      string
+	ControlFlag string
+	Actions     []string
+	Escalate    bool
+}
+
+func (s Script) data(binary, target string) *scriptData {
+	d := &scriptData{
+		Name:        s.Config.Name,
+		Platform:    service.Platform(),
+		Binary:      s.Binary,
+		Target:      s.Config.Executable,
+		ControlFlag: s.ControlFlag,
+		Actions:     s.Actions,
+		// User services are installed for the current user, so they need no extra rights.
+		Escalate: !isUserService(s.Config),
+	}
+	if len(d.Binary) == 0 {
+		d.Binary = binary
+	}
+	if len(d.Target) == 0 {
+		d.Target = target
+	}
+	if len(d.ControlFlag) == 0 {
+		d.ControlFlag = "-service"
+	}
+	if len(d.Actions) == 0 {
+		d.Actions = []string{service.ControlAction[3], service.ControlAction[0]}
+	}
+	return d
+}
+
+func isUserService(c *service.Config) bool {
+	v, _ := c.Option["UserService"].(bool)
+	return v
+}
+
+// WriteShell writes a POSIX shell script. Unless the service is a user
+// service, the script runs itself again with sudo when not run as root.
+// The program is installed to Config.Executable or /usr/local/bin/<Name>.
+func (s Script) WriteShell(w io.Writer) error {
+	d := s.data(s.Config.Name, "/usr/local/bin/"+s.Config.Name)
+	return template.Must(template.New("").Funcs(template.FuncMap{
+		"q": shellQuote,
+	}).Parse(shellScript)).Execute(w, d)
+}
+
+// WritePowerShell writes a PowerShell script. When not run as an
+// administrator, the script starts itself again elevated. The program is
+// installed to Config.Executable or $env:ProgramFiles\<Name>\<Name>.exe.
+func (s Script) WritePowerShell(w io.Writer) error {
+	d := s.data(s.Config.Name+".exe", "")
+	return template.Must(template.New("").Funcs(template.FuncMap{
+		"q": powerShellQuote,
+	}).Parse(powerShellScript)).Execute(w, d)
+}
+
+// shellQuote quotes s as a single word for a POSIX shell.
+func shellQuote(s string) string {
+	return `'` + strings.Replace(s, `'`, `'\''`, -1) + `'`
+}
+
+// powerShellQuote quotes s as a verbatim PowerShell string.
+func powerShellQuote(s string) string {
+	return `'` + strings.Replace(s, `'`, `''`, -1) + `'`
+}
+
+const shellScript = `#!/bin/sh
+# Installs {{.Name}}. Generated on {{.Platform}}.
+set -e
+{{if .Escalate}}
+if [ "$(id -u)" -ne 0 ]; then
+    exec sudo "$0" "$@"
+fi
+{{end}}
+dir=$(cd "$(dirname "$0")" && pwd)
+target={{.Target|q}}
+
+mkdir -p "$(dirname "$target")"
+cp "$dir"/{{.Binary|q}} "$target"
+chmod 0755 "$target"
+{{range .Actions}}
+"$target" {{$.ControlFlag|q}} {{.|q}}{{end}}
+`
+
+const powerShellScript = `# Installs {{.Name}}. Generated on {{.Platform}}.
+$ErrorActionPreference = 'Stop'
+{{if .Escalate}}
+$principal = New-Object Security.Principal.WindowsPrincipal([Security.Principal.WindowsIdentity]::GetCurrent())
+if (-not $principal.IsInRole([Security.Principal.WindowsBuiltInRole]::Administrator)) {
+    Start-Process powershell -Verb RunAs -Wait -ArgumentList '-NoProfile', '-ExecutionPolicy', 'Bypass', '-File', ('"' + $PSCommandPath + '"')
+    exit
+}
+{{end}}
+{{if .Target}}$target = {{.Target|q}}{{else}}$target = Join-Path $env:ProgramFiles {{.Name|q}} | Join-Path -ChildPath {{.Binary|q}}{{end}}
+
+New-Item -ItemType Directory -Force -Path (Split-Path $target) | Out-Null
+Copy-Item -Force (Join-Path $PSScriptRoot {{.Binary|q}}) $target
+{{range .Actions}}
+& $target {{$.ControlFlag|q}} {{.|q}}
+if ($LASTEXITCODE -ne 0) { exit $LASTEXITCODE }{{end}}
+`
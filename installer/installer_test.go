@@ -0,0 +1,63 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"bytes"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/kardianos/service"
+)
+
+func TestWriteShell(t *testing.T) {
+	s := Script{Config: &service.Config{Name: "myd", Executable: "/opt/My App/myd"}}
+	var buf bytes.Buffer
+	if err := s.WriteShell(&buf); err != nil {
+		t.Fatal(err)
+	}
+	script := buf.String()
+	for _, want := range []string{
+		"exec sudo",
+		"target='/opt/My App/myd'",
+		`"$target" '-service' 'install'`,
+		`"$target" '-service' 'start'`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script missing %q:\n%s", want, script)
+		}
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if out, err := exec.Command("sh", "-n", "-c", script).CombinedOutput(); err != nil {
+		t.Errorf("script syntax: %v: %s", err, out)
+	}
+}
+
+func TestWritePowerShell(t *testing.T) {
+	s := Script{
+		Config:  &service.Config{Name: "myd", Option: service.KeyValue{"UserService": true}},
+		Actions: []string{"install"},
+	}
+	var buf bytes.Buffer
+	if err := s.WritePowerShell(&buf); err != nil {
+		t.Fatal(err)
+	}
+	script := buf.String()
+	for _, want := range []string{
+		"Join-Path $env:ProgramFiles 'myd' | Join-Path -ChildPath 'myd.exe'",
+		"& $target '-service' 'install'",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script missing %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "RunAs") || strings.Contains(script, "'start'") {
+		t.Errorf("unexpected elevation or start:\n%s", script)
+	}
+}
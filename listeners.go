@@ -0,0 +1,64 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation.
+const listenFDsStart = 3
+
+// Listeners returns the sockets passed to the process by systemd socket
+// activation, keyed by the FileDescriptorName of their socket unit, such as
+// SocketFileDescriptorName. Sockets without a name are keyed "unknown", as
+// systemd names them. It returns an empty map if the process was not
+// socket activated. The environment variables are unset so child processes
+// do not inherit the sockets.
+func Listeners() (map[string][]net.Listener, error) {
+	files := listenFiles()
+	listeners := make(map[string][]net.Listener, len(files))
+	for name, fs := range files {
+		for _, f := range fs {
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			listeners[name] = append(listeners[name], l)
+		}
+	}
+	return listeners, nil
+}
+
+// listenFiles reads LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES and returns
+// the passed files by name.
+func listenFiles() map[string][]*os.File {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	files := make(map[string][]*os.File)
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return files
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return files
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && len(names[i]) != 0 {
+			name = names[i]
+		}
+		fd := uintptr(listenFDsStart + i)
+		files[name] = append(files[name], os.NewFile(fd, name))
+	}
+	return files
+}
@@ -9,8 +9,15 @@ import (
 )
 
 func (c *Config) execPath() (string, error) {
-	if len(c.Executable) != 0 {
-		return filepath.Abs(c.Executable)
+	var path string
+	var err error
+	if exe := c.executable(); len(exe) != 0 {
+		path, err = filepath.Abs(exe)
+	} else {
+		path, err = osext.Executable()
 	}
-	return osext.Executable()
+	if err != nil {
+		return "", err
+	}
+	return c.resolveSymlinks(path)
 }
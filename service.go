@@ -62,8 +62,19 @@
 package service // import "github.com/kardianos/service"
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -75,10 +86,126 @@ const (
 	optionUserServiceDefault   = false
 	optionSessionCreate        = "SessionCreate"
 	optionSessionCreateDefault = false
+	optionLaunchdLabel         = "LaunchdLabel"
+	optionDescriptionExtra     = "DescriptionExtra"
+	optionExpectedChecksum     = "ExpectedChecksum"
+	optionInstallPrefix        = "InstallPrefix"
+	optionExecutableByOS       = "ExecutableByOS"
+	optionStopTimeout          = "StopTimeout"
+	optionTimeout              = "Timeout"
+	optionProgressFunc         = "ProgressFunc"
+	optionRestart              = "Restart"
+	optionOnStateChange        = "OnStateChange"
+	optionCaptureStderr        = "CaptureStderr"
+	optionCaptureStderrDefault = false
+
+	optionRestartOnCleanExit        = "RestartOnCleanExit"
+	optionRestartOnCleanExitDefault = false
+
+	optionStopOnUninstall        = "StopOnUninstall"
+	optionStopOnUninstallDefault = true
+
+	optionStartInterval         = "StartInterval"
+	optionStartCalendarInterval = "StartCalendarInterval"
+
+	optionPreserveSymlink        = "PreserveSymlink"
+	optionPreserveSymlinkDefault = false
 
 	optionRunWait      = "RunWait"
 	optionReloadSignal = "ReloadSignal"
 	optionPIDFile      = "PIDFile"
+	optionOnReload     = "OnReload"
+	optionIgnoreHUP    = "IgnoreHUP"
+	optionWatchConfig  = "WatchConfig"
+
+	optionManageSignals        = "ManageSignals"
+	optionManageSignalsDefault = true
+	optionStopChannel          = "StopChannel"
+	optionReraiseSignal        = "ReraiseSignal"
+	optionReraiseSignalDefault = false
+	optionLogIdentifierByLevel = "LogIdentifierByLevel"
+	optionSyslogAddress        = "SyslogAddress"
+
+	optionUnitFileMode        = "UnitFileMode"
+	optionUnitFileOwner       = "UnitFileOwner"
+	optionUnitFileGroup       = "UnitFileGroup"
+	optionNotifyAccess        = "NotifyAccess"
+	optionNotifyAccessDefault = "main"
+	optionAlsoSysV            = "AlsoSysV"
+	optionAlsoSysVDefault     = false
+	optionSystemdType         = "SystemdType"
+	optionRemainAfterExit     = "RemainAfterExit"
+	optionBusName             = "BusName"
+
+	optionStopSocketToo        = "StopSocketToo"
+	optionStopSocketTooDefault = false
+
+	optionSessionBus        = "SessionBus"
+	optionSessionBusDefault = false
+
+	optionEnableLinger                    = "EnableLinger"
+	optionEnableLingerDefault             = false
+	optionDisableLingerOnUninstall        = "DisableLingerOnUninstall"
+	optionDisableLingerOnUninstallDefault = false
+
+	optionIOSchedulingClass    = "IOSchedulingClass"
+	optionIOSchedulingPriority = "IOSchedulingPriority"
+	optionIOWeight             = "IOWeight"
+	optionSupplementaryGroups  = "SupplementaryGroups"
+	optionCGroupParent         = "CGroupParent"
+	optionCGroupLimits         = "CGroupLimits"
+
+	optionAppArmorProfile     = "AppArmorProfile"
+	optionAppArmorProfilePath = "AppArmorProfilePath"
+	optionRequiresMountsFor   = "RequiresMountsFor"
+	optionConflicts           = "Conflicts"
+	optionFixupOwnership      = "FixupOwnership"
+	optionPassEnvironment     = "PassEnvironment"
+	optionUnsetEnvironment    = "UnsetEnvironment"
+	optionDelegate            = "Delegate"
+	optionRestartSteps        = "RestartSteps"
+	optionRestartMaxDelaySec  = "RestartMaxDelaySec"
+	optionStartLimitAction    = "StartLimitAction"
+	optionProtectProc         = "ProtectProc"
+	optionProcSubset          = "ProcSubset"
+	optionSecurityPreset      = "SecurityPreset"
+	optionCollectMode         = "CollectMode"
+	optionExecStartPost       = "ExecStartPost"
+	optionOnFailure           = "OnFailure"
+	optionOnFailureCommand    = "OnFailureCommand"
+	optionPrivateNetwork      = "PrivateNetwork"
+
+	optionLenientDaemonReload        = "LenientDaemonReload"
+	optionLenientDaemonReloadDefault = false
+
+	optionStrictSystemdDetection        = "StrictSystemdDetection"
+	optionStrictSystemdDetectionDefault = false
+
+	optionMaskOnInstall        = "MaskOnInstall"
+	optionMaskOnInstallDefault = false
+
+	optionCPUAccounting    = "CPUAccounting"
+	optionMemoryAccounting = "MemoryAccounting"
+	optionTasksAccounting  = "TasksAccounting"
+	optionIOAccounting     = "IOAccounting"
+
+	optionConditionArchitecture   = "ConditionArchitecture"
+	optionConditionVirtualization = "ConditionVirtualization"
+
+	optionRuntimeDirectory = "RuntimeDirectory"
+	optionStateDirectory   = "StateDirectory"
+	optionLogsDirectory    = "LogsDirectory"
+	optionCacheDirectory   = "CacheDirectory"
+	optionPurgeData        = "PurgeData"
+	optionPurgeDataDefault = false
+
+	optionPassword              = "Password"
+	optionVirtualAccount        = "VirtualAccount"
+	optionVirtualAccountDefault = false
+	optionReadinessProbe        = "ReadinessProbe"
+
+	optionKeepManagerConnection        = "KeepManagerConnection"
+	optionKeepManagerConnectionDefault = false
 )
 
 // Config provides the setup for a Service. The Name field is required.
@@ -108,15 +235,204 @@ type Config struct {
 	UMask string
 
 	// System specific options.
+	//  * All
+	//    - CaptureStderr    bool (false) - Send the standard output and error of the process,
+	//      including the log package and runtime panics, to the service Logger while Run runs.
+	//      Run sets it up before Start. On Windows it swaps os.Stdout, os.Stderr and the log
+	//      output, so nothing may write to them then, such as goroutines started before Run.
+	//      A crash may exit before its last lines are logged.
+	//    - DescriptionExtra map[string]string () [{"Contact": "ops@example.com"}] - Metadata
+	//      appended to the Windows description and written into the systemd unit. A long
+	//      Description is cut short on Windows so that the entries fit.
+	//    - ExpectedChecksum string () - Hex SHA-256 of the executable checked by VerifyBinary.
+	//    - ExecutableByOS   map[string]string () [{"linux": "/usr/bin/myd"}] - Executable for
+	//      each GOOS, so one Config serves all platforms. Executable is used for the others.
+	//    - InstallPrefix    string () [/opt/myd] - Replaces ${PREFIX} in Executable,
+	//      WorkingDirectory, ChRoot and Arguments, for example ${PREFIX}/bin/myd.
+	//    - PreserveSymlink  bool (false) - Install the executable path as given instead of
+	//      resolving symlinks. Use when upgrades swap a stable symlink such as
+	//      /opt/myd/current; otherwise the service keeps running the old target.
+	//    - StopTimeout      time.Duration (system default) - How long the service manager waits
+	//      for the service to stop before killing it. A Drainer gets half of it.
+	//    - Timeout          time.Duration (system default) - Start and stop timeout together,
+	//      TimeoutSec= on systemd. StopTimeout wins over it for stopping. On Windows it is
+	//      also the wait hint reported while starting.
+	//    - ProgressFunc     func(step string) () - Called by Install before each step,
+	//      such as "writing unit file", "enabling" and "reloading daemon", and with
+	//      warnings about the install, which start with "warning: ".
+	//    - StopOnUninstall  bool (true) - Uninstall stops a running service and waits for it
+	//      before removing its files (systemd, launchd and Windows). On Windows it fails
+	//      if the service has not stopped within StopTimeout, as Stop and Restart do.
+	//    - OnStateChange    func(from, to State) () - Called by Run as the service goes from
+	//      StateStopped to StateStarting, StateRunning, StateStopping and StateStopped again,
+	//      or from StateStarting back to StateStopped if Start fails.
+	//    - Restart          string (on-failure) [no, on-success, on-failure, on-abnormal,
+	//      on-watchdog, on-abort, always] - Restart= of systemd.service(5), always with
+	//      RestartOnCleanExit. launchd maps it to KeepAlive and Windows to recovery actions,
+	//      of which it sets none unless Restart is set. Exit non-zero when Run returns an
+	//      error, or the failure is not seen.
+	//    - RestartOnCleanExit bool (false) - Without an explicit Restart, systemd, launchd with
+	//      KeepAlive left unset and upstart also restart the service after it exits cleanly,
+	//      as after Run stopped it for a signal. Otherwise only a failure, such as Start
+	//      returning an error or the process crashing, restarts it. A stop through the
+	//      service manager never restarts the service.
 	//  * OS X
-	//    - KeepAlive     bool (true)
+	//    - KeepAlive     bool (true, false if scheduled) - Left unset, the job is only kept alive
+	//      after it fails, unless RestartOnCleanExit is set.
 	//    - RunAtLoad     bool (false)
 	//    - UserService   bool (false) - Install as a current user service.
 	//    - SessionCreate bool (false) - Create a full user session.
+	//    - LaunchdLabel  string (Name) - Label and plist file name, for example com.example.myd.
+	//    - StartInterval int () - Run the job every this many seconds.
+	//    - StartCalendarInterval map[string]int () [{"Hour": 3, "Minute": 30}] - Run the job at
+	//      these Minute, Hour, Day, Weekday and Month values; a []map[string]int lists several times.
 	//  * POSIX
 	//    - RunWait      func() (wait for SIGNAL) - Do not install signal but wait for this function to return.
 	//    - ReloadSignal string () [USR1, ...] - Signal to send on reaload.
+	//    - ManageSignals bool (true) - If false, Run installs no signal handlers and waits for
+	//      RunWait or StopChannel instead, leaving signals to the embedding program. The
+	//      reload and WatchConfig handling are skipped too. Also used by an interactive
+	//      Windows Run.
+	//    - StopChannel <-chan struct{} () - Run stops the program once it is closed or receives.
+	//      Required when ManageSignals is false and RunWait is not set.
 	//    - PIDFile     string () [/run/prog.pid] - Location of the PID file.
+	//    - OnReload    func() error () - Called by Run on SIGHUP or ReloadSignal instead of stopping.
+	//      A program implementing Reloader is used if this is not set.
+	//    - IgnoreHUP   bool (false) - Ignore SIGHUP when there is no reload handler.
+	//      Otherwise SIGHUP terminates the process without calling Stop.
+	//    - WatchConfig string or []string () [/etc/myd.conf] - Files Run checks every second.
+	//      A change, once the file stops changing, calls the reload handler. Without one,
+	//      Run stops the program and returns an error, so a service manager that restarts
+	//      failed services (systemd, launchd KeepAlive, upstart) starts it with the new file.
+	//    - ReraiseSignal bool (false) - Once Stop returns without error, Run sends the signal
+	//      that stopped the service to the process again with its default action, so the
+	//      parent sees the process terminated by the signal instead of exiting with 0.
+	//    - LogIdentifierByLevel map[string]string () [{"error": "myd-alert"}] - Syslog tag, the
+	//      SYSLOG_IDENTIFIER in the journal, of the system logger for the error, warning and
+	//      info levels. Levels left out are tagged with Name.
+	//    - SyslogAddress string () [udp://logs.example:514, tcp://10.0.0.5] - Syslog server the
+	//      system logger sends to instead of the local syslog, for hosts without one. The port
+	//      defaults to 514. A TCP server must be reachable when the logger is created; after
+	//      that a failed write connects again, and errors that remain are sent on errs.
+	//  * Linux systemd
+	//    - UserService  bool (false) - Install to ~/.config/systemd/user and manage the unit with
+	//      systemctl --user. UserName, AlsoSysV and AppArmorProfilePath are not used.
+	//    - SessionBus   bool (false) - For a UserService that uses the session D-Bus: sets
+	//      DBUS_SESSION_BUS_ADDRESS and ties the unit to graphical-session.target.
+	//    - EnableLinger bool (false) - For a UserService: Install runs loginctl enable-linger for
+	//      the current user, so the user manager, and the service with it, starts at boot and
+	//      keeps running after the user logs out. Otherwise user services stop at logout.
+	//      System services do not belong to a session and need no linger.
+	//    - DisableLingerOnUninstall bool (false) - Uninstall runs loginctl disable-linger; leave
+	//      it off if other user services of the user rely on lingering.
+	//    - StrictSystemdDetection bool (false) - Use systemd only if it is PID 1. Containers
+	//      may have /run/systemd/system without running systemd; New then creates the service
+	//      for the next system that is detected, while Platform still names systemd.
+	//    - UnitFileMode int (0644) [0600, 0640] - Permissions of the unit and socket files.
+	//      Use for units that carry secrets; note systemctl cat then needs the same privilege.
+	//      A system unit whose arguments look like secrets, such as -password or TOKEN=...,
+	//      defaults to 0640 with group systemd-journal.
+	//    - UnitFileOwner string () [root] - User given the unit and socket files; they keep the
+	//      owner of the installing process otherwise. The user must exist.
+	//    - UnitFileGroup string () [adm] - Group given the unit and socket files, which must exist.
+	//    - NotifyAccess string (main) [none, main, exec, all] - Processes allowed to send sd_notify messages.
+	//      Only set when SystemdType is notify, unless given.
+	//    - AlsoSysV     bool (false) - Also install /etc/init.d/<Name> that forwards to systemctl.
+	//    - SystemdType  string () [simple, exec, forking, oneshot, notify, dbus, idle] - Type= of the unit.
+	//    - BusName      string () [com.example.Myd] - D-Bus name the service owns. Sets Type=dbus,
+	//      so systemd considers the service started once the name appears on the bus.
+	//    - StopSocketToo bool (false) - With WithSocket, Stop also stops the socket unit and
+	//      Start starts it. Otherwise a stopped service keeps its socket listening, and the
+	//      next connection starts the service again.
+	//    - RemainAfterExit bool (true for oneshot) - Keep a oneshot unit active after it exits,
+	//      so units ordered After= it wait for it to finish. A oneshot unit is not restarted.
+	//    - IOWeight     int () [1-10000] - Relative block IO weight of the unit.
+	//    - AppArmorProfile     string () - AppArmor profile to confine the service with.
+	//    - AppArmorProfilePath string () - Profile file copied to /etc/apparmor.d and loaded
+	//      on Install if AppArmor is enabled, and removed on Uninstall.
+	//    - RequiresMountsFor   []string () [/data] - Start only after the mounts for these paths.
+	//    - Conflicts           []string () [other-myd.service] - Units stopped when this one starts,
+	//      and that stop this one when they start.
+	//    - FixupOwnership      []string () [/var/lib/myd] - Directories given to UserName and its
+	//      login group before each start, with mode 0777 less UMask (0755 if UMask is unset).
+	//      Rendered as ExecStartPre=+ lines; the "+" runs them as root even though the
+	//      service itself runs as UserName. Requires UserName.
+	//    - PassEnvironment     []string () [HTTPS_PROXY, NO_PROXY] - Variables passed on from
+	//      the environment of systemd itself, which services do not inherit otherwise.
+	//    - UnsetEnvironment    []string () [LD_PRELOAD] - Variables removed from the environment.
+	//    - Delegate            bool or []string () [cpu, memory, pids] - Let the service manage
+	//      the cgroups below its own, for all or the listed controllers.
+	//    - RestartMaxDelaySec  int () [3600] - Grow the delay between restarts from 120 seconds
+	//      up to this many seconds. Needs systemd 254; Install fails on older versions.
+	//    - RestartSteps        int () [1-3600] - Number of steps to reach RestartMaxDelaySec.
+	//    - StartLimitAction    string () [reboot, poweroff, exit, ...] - Action taken when the
+	//      unit hits its start limit, which the unit sets to 10 starts in 5 seconds instead of
+	//      systemd's default of 5 in 10 seconds; systemd stops restarting it otherwise.
+	//    - CollectMode         string () [inactive, inactive-or-failed] - inactive-or-failed also
+	//      unloads the unit after it failed, so finished oneshot units do not pile up as failed.
+	//    - ExecStartPost       []string () [/usr/bin/myd-ready, -wait, 30s] - Readiness command
+	//      and its arguments. systemd runs it once the service has started and counts the unit
+	//      as started, so units ordered After= it start, only when the command succeeds. If it
+	//      fails the service is stopped. The command must be an existing executable.
+	//    - OnFailure           []string () [ops-alert@myd.service] - Units started when the service
+	//      enters the failed state.
+	//    - OnFailureCommand    []string () [/usr/bin/myd-alert, -to, ops] - Command, with its
+	//      arguments, of a <Name>-failure-notify.service oneshot unit that Install writes and adds
+	//      to OnFailure, and Uninstall removes. It runs as root, or as the user of a UserService;
+	//      systemd 251 and later set $MONITOR_UNIT to the failed unit. The command must be an
+	//      existing executable.
+	//    - LenientDaemonReload bool (false) - A failed daemon-reload at the end of Install or
+	//      Repair is logged to the system logger instead of returned. The unit file is in place,
+	//      but systemd may not see it until the next daemon-reload.
+	//    - MaskOnInstall       bool (false) - Install masks the unit instead of enabling it, so it
+	//      cannot be started, even as a dependency, until Unmask. Masking links the unit to
+	//      /dev/null, which takes precedence over the unit file. The unit file is where a lasting
+	//      mask would go, so the mask only lasts until reboot; the unit is not enabled meanwhile,
+	//      so it does not start at boot either. Uninstall unmasks the unit first.
+	//    - CPUAccounting, MemoryAccounting, TasksAccounting, IOAccounting bool () - Rendered as the
+	//      directives of the same names when set, to turn accounting on or off for the service
+	//      regardless of the system default. Usage needs CPUAccounting and MemoryAccounting.
+	//    - ProtectProc   string () [noaccess, invisible, ptraceable, default] - Whether /proc
+	//      shows the processes of other users; invisible hides them.
+	//    - ProcSubset    string () [all, pid] - pid hides the parts of /proc that are not about processes.
+	//    - SecurityPreset string () [strict] - Defaults for the sandboxing options; strict sets
+	//      ProtectProc invisible and ProcSubset pid. Options that are set win over the preset.
+	//    - PrivateNetwork bool (false) - Run the service in its own network namespace with only a
+	//      loopback device. With WithSocket the socket unit, which is outside the namespace, still
+	//      listens on the host and passes its connections in. Without it Install logs a warning,
+	//      as the service cannot reach the network at all.
+	//    - ConditionArchitecture   string () [x86-64, arm64, !arm] - Start only on this architecture.
+	//    - ConditionVirtualization string () [no, vm, container, kvm, !docker] - Start only on this
+	//      kind of host; "no" means bare metal. A leading "!" negates either condition.
+	//    - StateDirectory      []string () [myd] - Directories systemd creates below /var/lib
+	//      for the service, owned by UserName. RuntimeDirectory (/run), LogsDirectory (/var/log)
+	//      and CacheDirectory (/var/cache) are the same for their directories. User services
+	//      use $XDG_STATE_HOME, $XDG_STATE_HOME/log, $XDG_CACHE_HOME and $XDG_RUNTIME_DIR.
+	//    - PurgeData           bool (false) - Uninstall also removes those directories.
+	//  * Linux
+	//    - IOSchedulingClass    string () [realtime, best-effort, idle] - IO scheduling class.
+	//    - IOSchedulingPriority int () [0-7] - IO priority within the class, 0 is highest.
+	//      Not allowed with idle. SysV and Upstart apply both in Run with ioprio_set.
+	//    - SupplementaryGroups []string () [ssl-cert, docker] - Groups the service process is in
+	//      besides the primary group of UserName. The groups must exist. SysV and Upstart start
+	//      the program through setpriv from util-linux. Not for systemd user services.
+	//    - CGroupParent  string () [services] - SysV and Upstart: Run creates the cgroup v2 group
+	//      <CGroupParent>/<Name> below /sys/fs/cgroup, writes CGroupLimits and IOWeight (as
+	//      io.weight) into it and moves the process there. This needs write access to the
+	//      parent group and its ancestors, normally root, and enables the controllers of the
+	//      limits in their cgroup.subtree_control. systemd places services in cgroups itself.
+	//    - CGroupLimits  map[string]string () [{"memory.max": "512M", "pids.max": "64"}] -
+	//      Interface files of the group and their values.
+	//  * Windows
+	//    - Password       string () - Password of UserName.
+	//    - VirtualAccount bool (false) - Run as the virtual account NT SERVICE\<Name>, an
+	//      identity of its own with no password. Setting UserName to NT SERVICE\<Name>
+	//      does the same.
+	//    - ReadinessProbe func() error () - Called by Run after Start, every second until
+	//      it returns nil, before the service reports running. Gives up after Timeout, or
+	//      the stop timeout if Timeout is not set, and on a stop request.
+	//    - KeepManagerConnection bool (false) - Keep the service control manager connection
+	//      open between calls until Close, instead of connecting for each call.
 	Option KeyValue
 
 	// Optional field to generate a socket file
@@ -124,18 +440,31 @@ type Config struct {
 	SocketDescription  string // Long description of socket.
 	SocketListenStream string // Socket ListenStream.
 	SocketPartOf       string // Socket PartOf to stop socket when main service is manually stopped; value is service name (Name.service)
+
+	// Optional name of the socket file descriptors, the key of Listeners.
+	// Other socket units may pass descriptors to the service with their
+	// own names.
+	SocketFileDescriptorName string
 }
 
 var (
 	system         System
 	systemRegistry []System
+	systemErr      error // Set instead of system if initOverrideEnv names no system.
 )
 
+// initOverrideEnv names an environment variable that, set to the name of a
+// system such as "unix-systemv", makes the package use that system without
+// detecting one.
+const initOverrideEnv = "SERVICE_INIT_OVERRIDE"
+
 var (
 	// ErrNameFieldRequired is returned when Conifg.Name is empty.
 	ErrNameFieldRequired = errors.New("Config.Name field is required.")
 	// ErrNoServiceSystemDetected is returned when no system was detected.
 	ErrNoServiceSystemDetected = errors.New("No service system detected.")
+	// ErrNotSupported is returned when the chosen system does not support an operation.
+	ErrNotSupported = errors.New("Not supported by this service system.")
 )
 
 // New creates a new service based on a service interface and configuration.
@@ -144,11 +473,82 @@ func New(i Interface, c *Config) (Service, error) {
 		return nil, ErrNameFieldRequired
 	}
 	if system == nil {
-		return nil, ErrNoServiceSystemDetected
+		return nil, errNoSystem()
+	}
+	if !c.Option.bool(optionManageSignals, optionManageSignalsDefault) &&
+		c.Option.stopChannel() == nil && c.Option.funcSingle(optionRunWait, nil) == nil {
+		return nil, errNoStopChannel
+	}
+	if prefix := c.Option.string(optionInstallPrefix, ""); len(prefix) > 0 {
+		c = c.withPrefix(prefix)
 	}
 	return system.New(i, c)
 }
 
+var errNoStopChannel = errors.New("ManageSignals is false, but neither StopChannel nor RunWait is set.")
+
+// unmanagedWait returns what Run blocks on instead of signals when the
+// ManageSignals option is false, or nil if Run handles signals.
+func (c *Config) unmanagedWait() func() {
+	if c.Option.bool(optionManageSignals, optionManageSignalsDefault) {
+		return nil
+	}
+	if wait := c.Option.funcSingle(optionRunWait, nil); wait != nil {
+		return wait
+	}
+	stop := c.Option.stopChannel()
+	return func() { <-stop }
+}
+
+// executable returns the ExecutableByOS entry for the running platform, with
+// prefixToken replaced, or else Executable.
+func (c *Config) executable() string {
+	m, _ := c.Option[optionExecutableByOS].(map[string]string)
+	if path, ok := m[runtime.GOOS]; ok && len(path) != 0 {
+		return strings.Replace(path, prefixToken, c.Option.string(optionInstallPrefix, ""), -1)
+	}
+	return c.Executable
+}
+
+// resolveSymlinks returns path with symlinks evaluated, so the installed
+// service does not depend on links that may later change, unless the
+// PreserveSymlink option is set. The result is absolute; a path that does
+// not exist yet is only made absolute.
+func (c *Config) resolveSymlinks(path string) (string, error) {
+	if c.Option.bool(optionPreserveSymlink, optionPreserveSymlinkDefault) {
+		return path, nil
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		// The executable may not be deployed yet.
+		resolved, err = path, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(resolved)
+}
+
+// prefixToken is replaced by the InstallPrefix option.
+const prefixToken = "${PREFIX}"
+
+// withPrefix returns a copy of c with prefixToken replaced by prefix in
+// every path and argument.
+func (c *Config) withPrefix(prefix string) *Config {
+	e := *c
+	expand := func(s string) string {
+		return strings.Replace(s, prefixToken, prefix, -1)
+	}
+	e.Executable = expand(c.Executable)
+	e.WorkingDirectory = expand(c.WorkingDirectory)
+	e.ChRoot = expand(c.ChRoot)
+	e.Arguments = make([]string, len(c.Arguments))
+	for i, arg := range c.Arguments {
+		e.Arguments[i] = expand(arg)
+	}
+	return &e
+}
+
 // KeyValue provides a list of platform specific options. See platform docs for
 // more details.
 type KeyValue map[string]interface{}
@@ -197,6 +597,51 @@ func (kv KeyValue) float64(name string, defaultValue float64) float64 {
 	return defaultValue
 }
 
+// strings returns the value of the given name, assuming the value is a []string.
+// If the value isn't found or is not of the type, the defaultValue is returned.
+func (kv KeyValue) strings(name string, defaultValue []string) []string {
+	if v, found := kv[name]; found {
+		if castValue, is := v.([]string); is {
+			return castValue
+		}
+	}
+	return defaultValue
+}
+
+// duration returns the value of the given name, assuming the value is a time.Duration.
+// If the value isn't found or is not of the type, the defaultValue is returned.
+func (kv KeyValue) duration(name string, defaultValue time.Duration) time.Duration {
+	if v, found := kv[name]; found {
+		if castValue, is := v.(time.Duration); is {
+			return castValue
+		}
+	}
+	return defaultValue
+}
+
+// oneOf returns the string value of the given name if it is one of allowed.
+// If the value isn't found, the defaultValue is returned.
+func (kv KeyValue) oneOf(name string, defaultValue string, allowed ...string) (string, error) {
+	value := kv.string(name, defaultValue)
+	for _, a := range allowed {
+		if value == a {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("Option %s is %q, must be one of %q.", name, value, allowed)
+}
+
+// restartPolicies are the values of the Restart option.
+var restartPolicies = []string{"no", "on-success", "on-failure", "on-abnormal", "on-watchdog", "on-abort", "always"}
+
+// restart returns the Restart option, or defaultValue if it is not set.
+func (c *Config) restart(defaultValue string) (string, error) {
+	if _, found := c.Option[optionRestart]; !found {
+		return defaultValue, nil
+	}
+	return c.Option.oneOf(optionRestart, "", restartPolicies...)
+}
+
 // funcSingle returns the value of the given name, assuming the value is a float64.
 // If the value isn't found or is not of the type, the defaultValue is returned.
 func (kv KeyValue) funcSingle(name string, defaultValue func()) func() {
@@ -208,6 +653,62 @@ func (kv KeyValue) funcSingle(name string, defaultValue func()) func() {
 	return defaultValue
 }
 
+// stopChannel returns the StopChannel option, which may be given as a
+// chan struct{} or a <-chan struct{}.
+func (kv KeyValue) stopChannel() <-chan struct{} {
+	switch ch := kv[optionStopChannel].(type) {
+	case chan struct{}:
+		return ch
+	case <-chan struct{}:
+		return ch
+	}
+	return nil
+}
+
+// timeout returns the duration option name, or the Timeout option, or
+// defaultValue.
+func (c *Config) timeout(name string, defaultValue time.Duration) time.Duration {
+	return c.Option.duration(name, c.Option.duration(optionTimeout, defaultValue))
+}
+
+// progress reports an install step to the ProgressFunc option, if set.
+func (c *Config) progress(step string) {
+	if f, ok := c.Option[optionProgressFunc].(func(string)); ok {
+		f(step)
+	}
+}
+
+// warn reports a problem Install works around or leaves to the caller to
+// the ProgressFunc option, as a step starting with "warning: ".
+func (c *Config) warn(format string, a ...interface{}) {
+	c.progress("warning: " + fmt.Sprintf(format, a...))
+}
+
+// extraEntry is one entry of the DescriptionExtra option.
+type extraEntry struct {
+	Key, Value string
+}
+
+func (e extraEntry) String() string {
+	return e.Key + ": " + e.Value
+}
+
+// descriptionExtra returns the DescriptionExtra option sorted by key.
+// Newlines are replaced so each entry fits on one line.
+func (c *Config) descriptionExtra() []extraEntry {
+	m, _ := c.Option[optionDescriptionExtra].(map[string]string)
+	extra := make([]extraEntry, 0, len(m))
+	for k, v := range m {
+		extra = append(extra, extraEntry{oneLine(k), oneLine(v)})
+	}
+	sort.Slice(extra, func(i, j int) bool { return extra[i].Key < extra[j].Key })
+	return extra
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
 // Platform returns a description of the system service.
 func Platform() string {
 	if system == nil {
@@ -225,22 +726,113 @@ func Interactive() bool {
 	return system.Interactive()
 }
 
-func newSystem() System {
+// targeter is implemented by systems that know which boot target or
+// runlevel is active.
+type targeter interface {
+	currentTarget() (string, error)
+}
+
+// CurrentTarget returns the active boot target, such as "multi-user.target"
+// on systemd, or the current runlevel, such as "3", on SysV and Upstart.
+func CurrentTarget() (string, error) {
+	if system == nil {
+		return "", errNoSystem()
+	}
+	t, ok := system.(targeter)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	return t.currentTarget()
+}
+
+func newSystem() (System, error) {
+	if name := os.Getenv(initOverrideEnv); len(name) != 0 {
+		for _, choice := range systemRegistry {
+			if choice.String() == name {
+				return choice, nil
+			}
+		}
+		return nil, fmt.Errorf("Unknown service system %q in %s.", name, initOverrideEnv)
+	}
 	for _, choice := range systemRegistry {
 		if choice.Detect() == false {
 			continue
 		}
-		return choice
+		return choice, nil
 	}
-	return nil
+	return nil, nil
+}
+
+// errNoSystem returns why there is no system: an unknown override, or
+// ErrNoServiceSystemDetected.
+func errNoSystem() error {
+	if systemErr != nil {
+		return systemErr
+	}
+	return ErrNoServiceSystemDetected
 }
 
 // ChooseSystem chooses a system from the given system services.
-// SystemServices are considered in the order they are suggested.
+// SystemServices are considered in the order they are suggested, unless
+// the SERVICE_INIT_OVERRIDE environment variable names one of them, which
+// is then used without detection; New fails if it names none of them.
 // Calling this may change what Interactive and Platform return.
 func ChooseSystem(a ...System) {
 	systemRegistry = a
-	system = newSystem()
+	system, systemErr = newSystem()
+}
+
+// AddSystem registers a system after the built-in ones, so programs can
+// support an init system this package does not know, such as the bespoke
+// init of an embedded distribution. Systems are detected in the order
+// AvailableSystems returns them; use SetLinuxDetectionOrder to try the added
+// system first. Calling this may change what Interactive and Platform return.
+func AddSystem(s System) {
+	systems := make([]System, len(systemRegistry), len(systemRegistry)+1)
+	copy(systems, systemRegistry)
+	ChooseSystem(append(systems, s)...)
+}
+
+// SetLinuxDetectionOrder tries the named systems first, in the given order,
+// when choosing the system, followed by the others in their usual order.
+// The Linux systems are "linux-systemd", "linux-upstart" and "unix-systemv".
+// It is for hosts where the usual detection picks the wrong system, for
+// example one with systemd installed that boots with SysV.
+// Calling this may change what Interactive and Platform return.
+func SetLinuxDetectionOrder(names []string) error {
+	ordered, err := orderSystems(systemRegistry, names)
+	if err != nil {
+		return err
+	}
+	ChooseSystem(ordered...)
+	return nil
+}
+
+// orderSystems returns systems with the named ones first, in order.
+func orderSystems(systems []System, names []string) ([]System, error) {
+	ordered := make([]System, 0, len(systems))
+	used := make(map[int]bool, len(names))
+	for _, name := range names {
+		found := false
+		for i, s := range systems {
+			if s.String() == name {
+				if !used[i] {
+					ordered = append(ordered, s)
+					used[i] = true
+				}
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown service system %q.", name)
+		}
+	}
+	for i, s := range systems {
+		if !used[i] {
+			ordered = append(ordered, s)
+		}
+	}
+	return ordered, nil
 }
 
 // ChosenSystem returns the system that service will use.
@@ -295,6 +887,38 @@ type Interface interface {
 	Stop(s Service) error
 }
 
+// Reloader is an optional interface for programs that can reload their
+// configuration while running. On POSIX systems Run calls Reload when the
+// process receives SIGHUP or the ReloadSignal, instead of stopping.
+type Reloader interface {
+	Reload(s Service) error
+}
+
+// Drainer is an optional interface for programs that should finish
+// in-flight work before they are stopped, such as network services that
+// stop accepting connections and wait for open ones. When the service is
+// asked to stop, Run calls Drain before Stop. The context is done after half
+// of the stop timeout, so Stop runs before the service manager kills the process.
+type Drainer interface {
+	Drain(ctx context.Context) error
+}
+
+// drain calls Drain of the program of s if it implements Drainer,
+// allowing it half of stopTimeout.
+func drain(s Service, i Interface, stopTimeout time.Duration) {
+	d, ok := i.(Drainer)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout/2)
+	defer cancel()
+	if err := d.Drain(ctx); err != nil {
+		if l, lerr := s.Logger(nil); lerr == nil {
+			l.Warningf("Drain failed: %v", err)
+		}
+	}
+}
+
 // TODO: Add Configure to Service interface.
 
 // Service represents a service that can be run or controlled.
@@ -336,6 +960,392 @@ type Service interface {
 	String() string
 }
 
+// Status represents the state of a service as reported by the service system.
+type Status byte
+
+// Status of a service.
+const (
+	StatusUnknown Status = iota // Status could not be determined, or is in transition.
+	StatusRunning
+	StatusStopped
+)
+
+// State is a step of Run, reported to the OnStateChange option.
+type State byte
+
+// States of Run.
+const (
+	StateStopped  State = iota // Before Start and after Stop.
+	StateStarting              // Interface.Start is running.
+	StateRunning               // Start returned and Run waits to be stopped.
+	StateStopping              // Drainer.Drain and Interface.Stop are running.
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStopped:
+		return "stopped"
+	case StateStarting:
+		return "starting"
+	case StateRunning:
+		return "running"
+	case StateStopping:
+		return "stopping"
+	}
+	return fmt.Sprintf("State(%d)", s)
+}
+
+// stateTracker calls the OnStateChange option as Run changes state.
+type stateTracker struct {
+	onChange func(from, to State)
+	state    State
+}
+
+func (c *Config) states() *stateTracker {
+	f, _ := c.Option[optionOnStateChange].(func(from, to State))
+	return &stateTracker{onChange: f}
+}
+
+// set changes the state to s.
+func (t *stateTracker) set(s State) {
+	if s == t.state {
+		return
+	}
+	from := t.state
+	t.state = s
+	if t.onChange != nil {
+		t.onChange(from, s)
+	}
+}
+
+// statusAller is implemented by systems that can read the status of
+// several services at once.
+type statusAller interface {
+	statusAll(names []string) (map[string]Status, error)
+}
+
+// StatusAll returns the status of each named service using as few calls
+// to the service system as it allows. Services that are not installed are
+// left out of the result. On OS X the names are launchd labels.
+func StatusAll(names []string) (map[string]Status, error) {
+	if system == nil {
+		return nil, errNoSystem()
+	}
+	sa, ok := system.(statusAller)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if len(names) == 0 {
+		return map[string]Status{}, nil
+	}
+	return sa.statusAll(names)
+}
+
+// Instance is one of several services InstallInstances installs from one Config.
+type Instance struct {
+	// Name is appended to the Name of the Config after a dash, so "web"
+	// installs myd-web.
+	Name string
+
+	// Arguments replace those of the Config if not nil.
+	Arguments []string
+}
+
+// instanceMarker is the DescriptionExtra key that marks a service as an
+// instance of the Config its value names.
+const instanceMarker = "InstanceOf"
+
+// instanceLister is implemented by systems that can find the services
+// InstallInstances installed for a Config.
+type instanceLister interface {
+	instances(base string) ([]string, error)
+}
+
+// instanceConfig returns the Config of instance name of c.
+func instanceConfig(c *Config, name string, args []string) *Config {
+	ic := *c
+	ic.Name = c.Name + "-" + name
+	if len(c.DisplayName) != 0 {
+		ic.DisplayName = c.DisplayName + " (" + name + ")"
+	}
+	if args != nil {
+		ic.Arguments = args
+	}
+	ic.Option = make(KeyValue, len(c.Option)+1)
+	for k, v := range c.Option {
+		ic.Option[k] = v
+	}
+	extra := map[string]string{}
+	if m, ok := c.Option[optionDescriptionExtra].(map[string]string); ok {
+		for k, v := range m {
+			extra[k] = v
+		}
+	}
+	extra[instanceMarker] = c.Name
+	ic.Option[optionDescriptionExtra] = extra
+	return &ic
+}
+
+// InstallInstances installs one service for each instance, all running the
+// executable of c, and marks them as instances of c in their description.
+// If one fails to install, those installed before it are uninstalled again.
+// Only Windows is supported; use a systemd template unit on Linux.
+func InstallInstances(i Interface, c *Config, instances []Instance) error {
+	if system == nil {
+		return errNoSystem()
+	}
+	if _, ok := system.(instanceLister); !ok {
+		return ErrNotSupported
+	}
+	g := make(Group, len(instances))
+	for n, inst := range instances {
+		s, err := New(i, instanceConfig(c, inst.Name, inst.Arguments))
+		if err != nil {
+			return fmt.Errorf("Instance %s: %v", inst.Name, err)
+		}
+		g[n] = s
+	}
+	return g.InstallTx()
+}
+
+// Instances returns the names of the services InstallInstances installed
+// for c. Only Windows is supported.
+func Instances(c *Config) ([]string, error) {
+	if system == nil {
+		return nil, errNoSystem()
+	}
+	l, ok := system.(instanceLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return l.instances(c.Name)
+}
+
+// UninstallInstances uninstalls every service InstallInstances installed
+// for c. Only Windows is supported.
+func UninstallInstances(i Interface, c *Config) error {
+	names, err := Instances(c)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		ic := *c
+		ic.Name = name
+		s, err := New(i, &ic)
+		if err == nil {
+			err = s.Uninstall()
+		}
+		if err != nil {
+			return fmt.Errorf("Instance %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// managerLauncher is implemented by services that can tell whether the
+// service manager started the process to run them.
+type managerLauncher interface {
+	launchedByManager() bool
+}
+
+// LaunchedByManager reports whether the service manager started this process
+// to run s, so a program that is also a command line tool can decide between
+// calling Run and handling a command. Unlike Interactive it checks the
+// markers the service manager leaves for s in particular, such as the unit
+// cgroup on systemd and XPC_SERVICE_NAME on launchd. Elsewhere it is the
+// same as !Interactive().
+func LaunchedByManager(s Service) bool {
+	if l, ok := s.(managerLauncher); ok {
+		return l.launchedByManager()
+	}
+	return !Interactive()
+}
+
+// repairer is implemented by services that can restore a partial install.
+type repairer interface {
+	repair() error
+}
+
+// Repair restores an install that was interrupted part way, for example by
+// a crash, reporting each issue it fixes to the ProgressFunc option. It only
+// writes files that are missing and never rewrites existing ones, so it does
+// not apply configuration changes, and it does not start or stop the service.
+// If the main service file is missing, the files left behind are removed and
+// the service is installed again. Only systemd and SysV are supported.
+func Repair(s Service) error {
+	r, ok := s.(repairer)
+	if !ok {
+		return ErrNotSupported
+	}
+	return r.repair()
+}
+
+// unmasker is implemented by services that can be masked.
+type unmasker interface {
+	unmask() error
+}
+
+// Unmask lets a service installed with the MaskOnInstall option be started
+// and enables it. Only systemd is supported.
+func Unmask(s Service) error {
+	u, ok := s.(unmasker)
+	if !ok {
+		return ErrNotSupported
+	}
+	return u.unmask()
+}
+
+// Close releases the handles s keeps to the service manager, such as the
+// service control manager connection a Windows service with
+// KeepManagerConnection keeps. Long-lived tooling that sets that option
+// should Close services it no longer needs. A closed Service may still be
+// used; it opens the handles again. Services without handles return nil.
+func Close(s Service) error {
+	c, ok := s.(io.Closer)
+	if !ok {
+		return nil
+	}
+	return c.Close()
+}
+
+// cgrouper is implemented by services that run in their own cgroup.
+type cgrouper interface {
+	cgroup() (string, error)
+}
+
+// CGroup returns the cgroup of the running service relative to the cgroup
+// file system root, such as /system.slice/myd.service. It is empty while
+// the service is stopped. Only systemd is supported.
+func CGroup(s Service) (string, error) {
+	c, ok := s.(cgrouper)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	return c.cgroup()
+}
+
+// ResourceUsage is a snapshot of the resources a running service uses.
+type ResourceUsage struct {
+	// Memory is the memory in use, in bytes. On systemd it is that of the
+	// whole cgroup, elsewhere the resident memory of the main process.
+	Memory uint64
+
+	// CPU is the processor time used since the service started.
+	CPU time.Duration
+}
+
+// usageReader is implemented by services that can report their resource usage.
+type usageReader interface {
+	resourceUsage() (ResourceUsage, error)
+}
+
+// Usage returns the memory and processor time the running service uses.
+// On systemd it needs MemoryAccounting and CPUAccounting, which are on by
+// default on recent versions, and returns an error when they are off; the
+// options of the same names turn them on for the service.
+func Usage(s Service) (ResourceUsage, error) {
+	u, ok := s.(usageReader)
+	if !ok {
+		return ResourceUsage{}, ErrNotSupported
+	}
+	return u.resourceUsage()
+}
+
+// transitionReporter is implemented by services that can report whether
+// the service manager is starting or stopping them.
+type transitionReporter interface {
+	transitioning() (bool, error)
+}
+
+// IsTransitioning reports whether the service is between states, such as
+// starting, stopping or waiting to be restarted, so that a control action
+// issued now would overlap one underway. SysV is not supported.
+func IsTransitioning(s Service) (bool, error) {
+	t, ok := s.(transitionReporter)
+	if !ok {
+		return false, ErrNotSupported
+	}
+	return t.transitioning()
+}
+
+// startTimer is implemented by services that can report when they started.
+type startTimer interface {
+	startedAt() (time.Time, error)
+}
+
+// StartedAt returns when the running service last started, from which
+// callers can derive its uptime. It returns the zero time and an error if
+// the service is not running.
+func StartedAt(s Service) (time.Time, error) {
+	t, ok := s.(startTimer)
+	if !ok {
+		return time.Time{}, ErrNotSupported
+	}
+	return t.startedAt()
+}
+
+// portLister is implemented by services that can report what they listen on.
+type portLister interface {
+	listeningPorts() ([]string, error)
+}
+
+// ListeningPorts returns what the service listens on, as "tcp:addr:port",
+// "udp:addr:port" or "unix:path" entries. The sockets of a socket activated
+// service are included even while the service is not running. Only Linux
+// is supported.
+func ListeningPorts(s Service) ([]string, error) {
+	p, ok := s.(portLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return p.listeningPorts()
+}
+
+// JournalEntry is a structured entry of the system journal.
+type JournalEntry struct {
+	// Time is when the entry was received by the journal.
+	Time time.Time
+
+	// Priority is the syslog priority, 0 (emerg) to 7 (debug).
+	Priority int
+
+	// Message is the MESSAGE field.
+	Message string
+
+	// Fields holds every field of the entry, including those above, by
+	// name. Binary values are kept as their raw bytes.
+	Fields map[string]string
+}
+
+// journalReader is implemented by services whose logs are in the journal.
+type journalReader interface {
+	journalEntries(ctx context.Context, filter map[string]string) ([]JournalEntry, error)
+	followJournal(ctx context.Context, filter map[string]string) (<-chan JournalEntry, <-chan error, error)
+}
+
+// JournalEntries returns the journal entries of the service that match
+// every field in filter, such as {"PRIORITY": "3"}. Only systemd is
+// supported.
+func JournalEntries(ctx context.Context, s Service, filter map[string]string) ([]JournalEntry, error) {
+	j, ok := s.(journalReader)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return j.journalEntries(ctx, filter)
+}
+
+// FollowJournal is like JournalEntries, but sends new entries on the
+// returned channel as they are written until ctx is done. The entries
+// channel is closed when following ends; the error channel then receives
+// the error, if any, that ended it.
+func FollowJournal(ctx context.Context, s Service, filter map[string]string) (<-chan JournalEntry, <-chan error, error) {
+	j, ok := s.(journalReader)
+	if !ok {
+		return nil, nil, ErrNotSupported
+	}
+	return j.followJournal(ctx, filter)
+}
+
 // ControlAction list valid string texts to use in Control.
 var ControlAction = [5]string{"start", "stop", "restart", "install", "uninstall"}
 
@@ -362,6 +1372,191 @@ func Control(s Service, action string) error {
 	return nil
 }
 
+// InstallAndStart installs s and then starts it. If start fails and rollback
+// is true, s is uninstalled again so it is not left installed but not running.
+// The returned error names the step that failed.
+func InstallAndStart(s Service, rollback bool) error {
+	if err := s.Install(); err != nil {
+		return fmt.Errorf("Failed to install %v: %v", s, err)
+	}
+	err := s.Start()
+	if err == nil {
+		return nil
+	}
+	if !rollback {
+		return fmt.Errorf("Installed %v but failed to start: %v", s, err)
+	}
+	if uerr := s.Uninstall(); uerr != nil {
+		return fmt.Errorf("Failed to start %v: %v; rollback uninstall also failed: %v", s, err, uerr)
+	}
+	return fmt.Errorf("Failed to start %v, uninstalled again: %v", s, err)
+}
+
+// Group is a set of services installed together, such as the cooperating
+// daemons of one application.
+type Group []Service
+
+// InstallTx installs the services of g in order, all or nothing. If one
+// fails to install, those installed before it are uninstalled again, the
+// last first, and the install error is returned along with any rollback
+// failures.
+func (g Group) InstallTx() error {
+	for n, s := range g {
+		err := s.Install()
+		if err == nil {
+			continue
+		}
+		msg := fmt.Sprintf("Failed to install %v: %v", s, err)
+		for k := n - 1; k >= 0; k-- {
+			if uerr := g[k].Uninstall(); uerr != nil {
+				msg += fmt.Sprintf("; rollback uninstall of %v also failed: %v", g[k], uerr)
+			}
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// verifiedInstaller is implemented by services that can replace their
+// installed configuration and roll back.
+type verifiedInstaller interface {
+	installVerified(backupPath string) error
+}
+
+// InstallVerified installs s for a self-upgrade. It copies the installed
+// configuration of s, if any, to backupPath and replaces it with the current
+// one, then restarts s and waits up to the Timeout option (10 seconds by
+// default) for it to run. If s does not run, the backup is restored and s
+// restarted with it. Only systemd is supported.
+func InstallVerified(s Service, backupPath string) error {
+	v, ok := s.(verifiedInstaller)
+	if !ok {
+		return ErrNotSupported
+	}
+	return v.installVerified(backupPath)
+}
+
+// programmer is implemented by every service of this package and returns
+// the program it was created with.
+type programmer interface {
+	program() Interface
+}
+
+// Begin calls Start on the program of s and returns immediately with a
+// function that calls Stop. Unlike Run it installs no signal handlers and
+// does not block, so an application embedding the service can drive its
+// lifecycle from its own event loop. Calling stop more than once only stops
+// the program once.
+//
+// Begin does not communicate with the OS service manager; a program started
+// by the Windows service manager must call Run.
+func Begin(s Service) (stop func() error, err error) {
+	p, ok := s.(programmer)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	i := p.program()
+	if err = i.Start(s); err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() error {
+		var err error
+		once.Do(func() { err = i.Stop(s) })
+		return err
+	}, nil
+}
+
+// installedPather is implemented by services that can read the
+// executable path back from their installed configuration.
+type installedPather interface {
+	installedPath() (string, error)
+	config() *Config
+}
+
+// VerifyBinary checks that the executable referenced by the installed
+// service is the configured executable, exists and is executable. If the
+// ExpectedChecksum option is set, the SHA-256 of the file must match it.
+func VerifyBinary(s Service) error {
+	p, ok := s.(installedPather)
+	if !ok {
+		return ErrNotSupported
+	}
+	installed, err := p.installedPath()
+	if err != nil {
+		return err
+	}
+	c := p.config()
+	want, err := c.execPath()
+	if err != nil {
+		return err
+	}
+	if installed != want && !(runtime.GOOS == "windows" && strings.EqualFold(installed, want)) {
+		return fmt.Errorf("Installed service runs %s, configured executable is %s.", installed, want)
+	}
+	fi, err := os.Stat(installed)
+	if err != nil {
+		return fmt.Errorf("Installed executable: %v", err)
+	}
+	if fi.IsDir() || (runtime.GOOS != "windows" && fi.Mode()&0111 == 0) {
+		return fmt.Errorf("Installed executable %s is not executable.", installed)
+	}
+	expected := c.Option.string(optionExpectedChecksum, "")
+	if len(expected) == 0 {
+		return nil
+	}
+	f, err := os.Open(installed)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, expected) {
+		return fmt.Errorf("Installed executable %s has SHA-256 %s, expected %s.", installed, got, expected)
+	}
+	return nil
+}
+
+// config returns c. Services embed *Config, so this gives access to the
+// configuration of any service of this package.
+func (c *Config) config() *Config {
+	return c
+}
+
+// execer is implemented by services whose system has a control command
+// that can run arbitrary verbs against the service.
+type execer interface {
+	exec(args ...string) (string, error)
+}
+
+// Exec runs the control command of the service system with args, targeting s,
+// and returns its combined standard output and error, which is also returned
+// if the command fails. A CommandRunner set with SetCommandRunner returns only
+// the standard output unless it also has a RunCombined method like Run. On
+// systemd
+//
+//	Exec(s, "freeze")
+//
+// runs "systemctl freeze <name>.service". Only the verbs that act on a single
+// unit or job are run on systemd and upstart, so verbs that act on the whole
+// system, such as reboot or emit, are refused.
+//
+// Exec is an escape hatch for verbs that this package does not otherwise
+// support; the output is not parsed and may differ between system versions.
+func Exec(s Service, args ...string) (string, error) {
+	e, ok := s.(execer)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	if len(args) == 0 {
+		return "", errors.New("Exec requires a command.")
+	}
+	return e.exec(args...)
+}
+
 // Logger writes to the system log.
 type Logger interface {
 	Error(v ...interface{}) error
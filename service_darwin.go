@@ -7,10 +7,16 @@ package service
 import (
 	"errors"
 	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/signal"
 	"os/user"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"text/template"
 	"time"
@@ -18,6 +24,9 @@ import (
 
 const maxPathSize = 32 * 1024
 
+// launchdDefaultExitTimeOut is the default of the ExitTimeOut key.
+const launchdDefaultExitTimeOut = 20 * time.Second
+
 const version = "darwin-launchd"
 
 type darwinSystem struct{}
@@ -37,11 +46,45 @@ func (darwinSystem) New(i Interface, c *Config) (Service, error) {
 		Config: c,
 
 		userService: c.Option.bool(optionUserService, optionUserServiceDefault),
+		label:       c.Option.string(optionLaunchdLabel, c.Name),
+	}
+	if _, ok := c.Option[optionLaunchdLabel]; ok && !validLaunchdLabel.MatchString(s.label) {
+		return nil, fmt.Errorf("Invalid launchd label %q: use reverse-DNS characters only, such as com.example.myd", s.label)
 	}
 
 	return s, nil
 }
 
+// validLaunchdLabel matches labels launchd accepts and that are safe to use as
+// a plist file name.
+var validLaunchdLabel = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// statusAll reads the status of all jobs from one launchctl list. Its lines
+// hold the PID, or "-" if not running, the last exit status and the label.
+func (darwinSystem) statusAll(labels []string) (map[string]Status, error) {
+	out, err := runWithOutput("launchctl", "list")
+	if err != nil {
+		return nil, err
+	}
+	want := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		want[label] = true
+	}
+	status := make(map[string]Status, len(labels))
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !want[fields[2]] {
+			continue
+		}
+		if fields[0] == "-" {
+			status[fields[2]] = StatusStopped
+		} else {
+			status[fields[2]] = StatusRunning
+		}
+	}
+	return status, nil
+}
+
 func init() {
 	ChooseSystem(darwinSystem{})
 }
@@ -56,6 +99,11 @@ func init() {
 	}
 }
 
+// dupTo makes newfd a copy of oldfd.
+func dupTo(oldfd, newfd int) error {
+	return syscall.Dup2(oldfd, newfd)
+}
+
 func isInteractive() (bool, error) {
 	// TODO: The PPID of Launchd is 1. The PPid of a service process should match launchd's PID.
 	return os.Getppid() != 1, nil
@@ -66,6 +114,7 @@ type darwinLaunchdService struct {
 	*Config
 
 	userService bool
+	label       string
 }
 
 func (s *darwinLaunchdService) String() string {
@@ -75,6 +124,127 @@ func (s *darwinLaunchdService) String() string {
 	return s.Name
 }
 
+// launchedByManager checks XPC_SERVICE_NAME, which launchd sets to the label.
+func (s *darwinLaunchdService) launchedByManager() bool {
+	return os.Getenv("XPC_SERVICE_NAME") == s.label
+}
+
+// pid finds the PID of the running job in launchctl list.
+func (s *darwinLaunchdService) pid() (string, error) {
+	out, err := runWithOutput("launchctl", "list")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 && fields[2] == s.label && fields[0] != "-" {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("%s is not running.", s.Name)
+}
+
+// resourceUsage reads the resident memory, in KiB, and processor time of
+// the job process with ps.
+func (s *darwinLaunchdService) resourceUsage() (ResourceUsage, error) {
+	var u ResourceUsage
+	pid, err := s.pid()
+	if err != nil {
+		return u, err
+	}
+	out, err := runWithOutput("ps", "-o", "rss=,time=", "-p", pid)
+	if err != nil {
+		return u, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return u, fmt.Errorf("Unexpected ps output %q.", out)
+	}
+	kib, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return u, err
+	}
+	u.Memory = kib * 1024
+	u.CPU, err = psTime(fields[1])
+	return u, err
+}
+
+// startedAt subtracts the elapsed time ps reports for the job process
+// from now; it has a resolution of one second.
+func (s *darwinLaunchdService) startedAt() (time.Time, error) {
+	pid, err := s.pid()
+	if err != nil {
+		return time.Time{}, err
+	}
+	out, err := runWithOutput("ps", "-o", "etime=", "-p", pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	elapsed, err := psTime(strings.TrimSpace(out))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(-elapsed).Truncate(time.Second), nil
+}
+
+// transitioning reads the job state from launchctl print. A settled job is
+// "running", "not running" or "waiting"; others, such as "spawn scheduled",
+// mean launchd is starting or stopping it.
+func (s *darwinLaunchdService) transitioning() (bool, error) {
+	domain := "system"
+	if s.userService {
+		domain = "gui/" + strconv.Itoa(os.Getuid())
+	}
+	out, err := runWithOutput("launchctl", "print", domain+"/"+s.label)
+	if err != nil {
+		return false, err
+	}
+	// The first state line is that of the job; nested sections follow.
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "state = ") {
+			continue
+		}
+		switch strings.TrimPrefix(line, "state = ") {
+		case "running", "not running", "waiting":
+			return false, nil
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("No state in launchctl print output for %s.", s.label)
+}
+
+// psTime parses a time printed by ps, [[dd-]hh:]mm:ss.ss.
+func psTime(s string) (time.Duration, error) {
+	var d time.Duration
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		days, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, err
+		}
+		d, s = time.Duration(days)*24*time.Hour, s[i+1:]
+	}
+	parts := strings.Split(s, ":")
+	sec, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, err
+	}
+	d += time.Duration(sec * float64(time.Second))
+	unit := time.Minute
+	for i := len(parts) - 2; i >= 0; i-- {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(n) * unit
+		unit = time.Hour
+	}
+	return d, nil
+}
+
+func (s *darwinLaunchdService) program() Interface {
+	return s.i
+}
+
 func (s *darwinLaunchdService) getHomeDir() (string, error) {
 	u, err := user.Current()
 	if err == nil {
@@ -95,9 +265,28 @@ func (s *darwinLaunchdService) getServiceFilePath() (string, error) {
 		if err != nil {
 			return "", err
 		}
-		return homeDir + "/Library/LaunchAgents/" + s.Name + ".plist", nil
+		return homeDir + "/Library/LaunchAgents/" + s.label + ".plist", nil
 	}
-	return "/Library/LaunchDaemons/" + s.Name + ".plist", nil
+	return "/Library/LaunchDaemons/" + s.label + ".plist", nil
+}
+
+var programArgumentsExp = regexp.MustCompile(`<key>ProgramArguments</key>\s*<array>\s*<string>([^<]*)</string>`)
+
+// installedPath reads the first of the ProgramArguments of the installed plist.
+func (s *darwinLaunchdService) installedPath() (string, error) {
+	confPath, err := s.getServiceFilePath()
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		return "", err
+	}
+	m := programArgumentsExp.FindSubmatch(b)
+	if m == nil {
+		return "", fmt.Errorf("No ProgramArguments in %s.", confPath)
+	}
+	return html.UnescapeString(string(m[1])), nil
 }
 
 func (s *darwinLaunchdService) Install() error {
@@ -118,31 +307,133 @@ func (s *darwinLaunchdService) Install() error {
 		}
 	}
 
-	f, err := os.Create(confPath)
+	path, err := s.execPath()
+	if err != nil {
+		return err
+	}
+	to, err := s.templateData(path)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	path, err := s.execPath()
+	s.progress("writing plist")
+	f, err := os.Create(confPath)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	var to = &struct {
-		*Config
-		Path string
+	return s.render(f, to)
+}
+
+// launchdTemplateData is rendered into the plist.
+type launchdTemplateData struct {
+	*Config
+	Path  string
+	Label string
 
-		KeepAlive, RunAtLoad bool
-		SessionCreate        bool
-	}{
+	KeepAlive, RunAtLoad bool
+	SessionCreate        bool
+
+	// KeepAliveKey, if set, makes KeepAlive a dictionary holding this key
+	// with the value KeepAliveValue.
+	KeepAliveKey   string
+	KeepAliveValue bool
+
+	StartInterval         int
+	StartCalendarInterval []calendarInterval
+
+	ExitTimeOut int
+}
+
+// calendarInterval is one entry of StartCalendarInterval. Keys are
+// sorted so the plist is stable.
+type calendarInterval []calendarField
+
+type calendarField struct {
+	Key   string
+	Value int
+}
+
+// calendarRanges lists the keys launchd accepts in StartCalendarInterval
+// and their valid values. Weekday 0 and 7 are both Sunday.
+var calendarRanges = map[string][2]int{
+	"Minute":  {0, 59},
+	"Hour":    {0, 23},
+	"Day":     {1, 31},
+	"Weekday": {0, 7},
+	"Month":   {1, 12},
+}
+
+// templateData reads and validates the options rendered into the plist.
+func (s *darwinLaunchdService) templateData(path string) (*launchdTemplateData, error) {
+	to := &launchdTemplateData{
 		Config:        s.Config,
 		Path:          path,
-		KeepAlive:     s.Option.bool(optionKeepAlive, optionKeepAliveDefault),
+		Label:         s.label,
 		RunAtLoad:     s.Option.bool(optionRunAtLoad, optionRunAtLoadDefault),
 		SessionCreate: s.Option.bool(optionSessionCreate, optionSessionCreateDefault),
+		StartInterval: s.Option.int(optionStartInterval, 0),
+		ExitTimeOut:   int((s.timeout(optionStopTimeout, 0) + time.Second - 1) / time.Second),
+	}
+	if to.StartInterval < 0 {
+		return nil, fmt.Errorf("%s must not be negative.", optionStartInterval)
+	}
+
+	var entries []map[string]int
+	switch v := s.Option[optionStartCalendarInterval].(type) {
+	case nil:
+	case map[string]int:
+		entries = []map[string]int{v}
+	case []map[string]int:
+		entries = v
+	default:
+		return nil, fmt.Errorf("%s must be a map[string]int or []map[string]int, not %T.", optionStartCalendarInterval, v)
+	}
+	for _, entry := range entries {
+		var ci calendarInterval
+		for key, value := range entry {
+			r, ok := calendarRanges[key]
+			if !ok {
+				return nil, fmt.Errorf("%s has unknown key %q.", optionStartCalendarInterval, key)
+			}
+			if value < r[0] || value > r[1] {
+				return nil, fmt.Errorf("%s %s is %d, must be from %d to %d.", optionStartCalendarInterval, key, value, r[0], r[1])
+			}
+			ci = append(ci, calendarField{key, value})
+		}
+		sort.Slice(ci, func(i, j int) bool { return ci[i].Key < ci[j].Key })
+		to.StartCalendarInterval = append(to.StartCalendarInterval, ci)
 	}
 
+	// A scheduled job runs periodically instead of being kept alive.
+	scheduled := to.StartInterval > 0 || len(to.StartCalendarInterval) > 0
+	to.KeepAlive = s.Option.bool(optionKeepAlive, optionKeepAliveDefault && !scheduled)
+	// Only a KeepAlive by default keeps the job alive just after failures.
+	defaultRestart := ""
+	if _, set := s.Option[optionKeepAlive]; !set && to.KeepAlive && !s.Option.bool(optionRestartOnCleanExit, optionRestartOnCleanExitDefault) {
+		defaultRestart = "on-failure"
+	}
+	restart, err := s.restart(defaultRestart)
+	if err != nil {
+		return nil, err
+	}
+	// Crashed only covers crash signals such as SIGSEGV, not timeouts or
+	// watchdog kills, so the last three policies restart less than on systemd.
+	switch restart {
+	case "always":
+		to.KeepAlive = true
+	case "no":
+		to.KeepAlive = false
+	case "on-success", "on-failure":
+		to.KeepAliveKey, to.KeepAliveValue = "SuccessfulExit", restart == "on-success"
+	case "on-abnormal", "on-watchdog", "on-abort":
+		to.KeepAliveKey, to.KeepAliveValue = "Crashed", true
+	}
+	return to, nil
+}
+
+func (s *darwinLaunchdService) render(w io.Writer, to *launchdTemplateData) error {
 	functions := template.FuncMap{
 		"bool": func(v bool) string {
 			if v {
@@ -152,11 +443,14 @@ func (s *darwinLaunchdService) Install() error {
 		},
 	}
 	t := template.Must(template.New("launchdConfig").Funcs(functions).Parse(launchdConfig))
-	return t.Execute(f, to)
+	return t.Execute(w, to)
 }
 
 func (s *darwinLaunchdService) Uninstall() error {
-	s.Stop()
+	if s.Option.bool(optionStopOnUninstall, optionStopOnUninstallDefault) {
+		// Fails if the job is not loaded, which is fine here.
+		s.Stop()
+	}
 
 	confPath, err := s.getServiceFilePath()
 	if err != nil {
@@ -188,20 +482,24 @@ func (s *darwinLaunchdService) Restart() error {
 	return s.Start()
 }
 
-func (s *darwinLaunchdService) Run() error {
-	var err error
+func (s *darwinLaunchdService) Run() (err error) {
+	var sig os.Signal
+	defer func() { err = reraise(s.Config, sig, err) }()
+	defer redirectOutput(s, s.Config)()
+	states := s.states()
+	defer states.set(StateStopped)
 
+	states.set(StateStarting)
 	err = s.i.Start(s)
 	if err != nil {
 		return err
 	}
+	states.set(StateRunning)
 
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
+	sig = runWait(s, s.Config, s.i, syscall.SIGTERM, os.Interrupt)
+	states.set(StateStopping)
 
+	drain(s, s.i, s.timeout(optionStopTimeout, launchdDefaultExitTimeOut))
 	return s.i.Stop(s)
 }
 
@@ -212,7 +510,7 @@ func (s *darwinLaunchdService) Logger(errs chan<- error) (Logger, error) {
 	return s.SystemLogger(errs)
 }
 func (s *darwinLaunchdService) SystemLogger(errs chan<- error) (Logger, error) {
-	return newSysLogger(s.Name, errs)
+	return newSysLogger(s.Name, s.Option, errs)
 }
 
 var launchdConfig = `<?xml version='1.0' encoding='UTF-8'?>
@@ -220,7 +518,7 @@ var launchdConfig = `<?xml version='1.0' encoding='UTF-8'?>
 "http://www.apple.com/DTDs/PropertyList-1.0.dtd" >
 <plist version='1.0'>
 <dict>
-<key>Label</key><string>{{html .Name}}</string>
+<key>Label</key><string>{{html .Label}}</string>
 <key>ProgramArguments</key>
 <array>
         <string>{{html .Path}}</string>
@@ -232,8 +530,14 @@ var launchdConfig = `<?xml version='1.0' encoding='UTF-8'?>
 {{if .ChRoot}}<key>RootDirectory</key><string>{{html .ChRoot}}</string>{{end}}
 {{if .WorkingDirectory}}<key>WorkingDirectory</key><string>{{html .WorkingDirectory}}</string>{{end}}
 <key>SessionCreate</key><{{bool .SessionCreate}}/>
-<key>KeepAlive</key><{{bool .KeepAlive}}/>
+<key>KeepAlive</key>{{if .KeepAliveKey}}<dict><key>{{.KeepAliveKey}}</key><{{bool .KeepAliveValue}}/></dict>{{else}}<{{bool .KeepAlive}}/>{{end}}
 <key>RunAtLoad</key><{{bool .RunAtLoad}}/>
+{{if .ExitTimeOut}}<key>ExitTimeOut</key><integer>{{.ExitTimeOut}}</integer>{{end}}
+{{if .StartInterval}}<key>StartInterval</key><integer>{{.StartInterval}}</integer>{{end}}
+{{if .StartCalendarInterval}}<key>StartCalendarInterval</key>
+<array>
+{{range .StartCalendarInterval}}        <dict>{{range .}}<key>{{.Key}}</key><integer>{{.Value}}</integer>{{end}}</dict>
+{{end}}</array>{{end}}
 <key>Disabled</key><false/>
 </dict>
 </plist>
@@ -0,0 +1,119 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func renderLaunchd(t *testing.T, s *darwinLaunchdService, path string) string {
+	to, err := s.templateData(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.render(&buf, to); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestLaunchdSpacedPath(t *testing.T) {
+	s := &darwinLaunchdService{
+		Config: &Config{Name: "myd", Arguments: []string{"-config", "/etc/My App/myd.conf"}},
+		label:  "myd",
+	}
+	plist := renderLaunchd(t, s, "/opt/My App/bin/myd")
+	for _, want := range []string{
+		"<string>/opt/My App/bin/myd</string>",
+		"<string>/etc/My App/myd.conf</string>",
+	} {
+		if !strings.Contains(plist, want) {
+			t.Errorf("plist missing %q:\n%s", want, plist)
+		}
+	}
+}
+
+func TestLaunchdCalendarInterval(t *testing.T) {
+	s := &darwinLaunchdService{
+		Config: &Config{Name: "myd", Option: KeyValue{
+			optionStartCalendarInterval: []map[string]int{{"Hour": 3, "Minute": 30}, {"Weekday": 0}},
+		}},
+		label: "myd",
+	}
+	plist := renderLaunchd(t, s, "/usr/local/bin/myd")
+	for _, want := range []string{
+		"<dict><key>Hour</key><integer>3</integer><key>Minute</key><integer>30</integer></dict>",
+		"<dict><key>Weekday</key><integer>0</integer></dict>",
+		"<key>KeepAlive</key><false/>",
+	} {
+		if !strings.Contains(plist, want) {
+			t.Errorf("plist missing %q:\n%s", want, plist)
+		}
+	}
+
+	s.Option[optionStartCalendarInterval] = map[string]int{"Hour": 24}
+	if _, err := s.templateData("/usr/local/bin/myd"); err == nil {
+		t.Error("Hour 24 accepted")
+	}
+}
+
+func TestPsTime(t *testing.T) {
+	for in, want := range map[string]time.Duration{
+		"0:00.52":    520 * time.Millisecond,
+		"12:03.00":   12*time.Minute + 3*time.Second,
+		"1:02:03":    time.Hour + 2*time.Minute + 3*time.Second,
+		"2-01:00:00": 49 * time.Hour,
+	} {
+		got, err := psTime(in)
+		if err != nil || got != want {
+			t.Errorf("psTime(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+}
+
+func TestLaunchdRestart(t *testing.T) {
+	s := &darwinLaunchdService{Config: &Config{Name: "myd", Option: KeyValue{}}, label: "myd"}
+	for restart, want := range map[string]string{
+		"always":      "<key>KeepAlive</key><true/>",
+		"no":          "<key>KeepAlive</key><false/>",
+		"on-failure":  "<key>KeepAlive</key><dict><key>SuccessfulExit</key><false/></dict>",
+		"on-abnormal": "<key>KeepAlive</key><dict><key>Crashed</key><true/></dict>",
+	} {
+		s.Option[optionRestart] = restart
+		if plist := renderLaunchd(t, s, "/usr/local/bin/myd"); !strings.Contains(plist, want) {
+			t.Errorf("Restart %s: plist missing %q:\n%s", restart, want, plist)
+		}
+	}
+}
+
+func TestLaunchdRestartOnCleanExit(t *testing.T) {
+	s := &darwinLaunchdService{Config: &Config{Name: "myd", Option: KeyValue{}}, label: "myd"}
+	for _, c := range []struct {
+		option KeyValue
+		want   string
+	}{
+		{KeyValue{}, "<key>KeepAlive</key><dict><key>SuccessfulExit</key><false/></dict>"},
+		{KeyValue{optionRestartOnCleanExit: true}, "<key>KeepAlive</key><true/>"},
+		{KeyValue{optionKeepAlive: true}, "<key>KeepAlive</key><true/>"},
+	} {
+		s.Option = c.option
+		if plist := renderLaunchd(t, s, "/usr/local/bin/myd"); !strings.Contains(plist, c.want) {
+			t.Errorf("options %v: plist missing %q:\n%s", c.option, c.want, plist)
+		}
+	}
+}
+
+func TestLaunchdLabel(t *testing.T) {
+	if _, err := (darwinSystem{}).New(nil, &Config{Name: "My Daemon"}); err != nil {
+		t.Errorf("Name without LaunchdLabel: %v", err)
+	}
+	if _, err := (darwinSystem{}).New(nil, &Config{Name: "myd", Option: KeyValue{optionLaunchdLabel: "com.example/myd"}}); err == nil {
+		t.Error("invalid LaunchdLabel accepted")
+	}
+}
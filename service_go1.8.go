@@ -8,8 +8,15 @@ import (
 )
 
 func (c *Config) execPath() (string, error) {
-	if len(c.Executable) != 0 {
-		return filepath.Abs(c.Executable)
+	var path string
+	var err error
+	if exe := c.executable(); len(exe) != 0 {
+		path, err = filepath.Abs(exe)
+	} else {
+		path, err = os.Executable()
 	}
-	return os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return c.resolveSymlinks(path)
 }
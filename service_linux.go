@@ -5,8 +5,21 @@
 package service
 
 import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type linuxSystemService struct {
@@ -14,6 +27,8 @@ type linuxSystemService struct {
 	detect      func() bool
 	interactive func() bool
 	new         func(i Interface, c *Config) (Service, error)
+	target      func() (string, error)
+	status      func(names []string) (map[string]Status, error)
 }
 
 func (sc linuxSystemService) String() string {
@@ -28,6 +43,12 @@ func (sc linuxSystemService) Interactive() bool {
 func (sc linuxSystemService) New(i Interface, c *Config) (Service, error) {
 	return sc.new(i, c)
 }
+func (sc linuxSystemService) currentTarget() (string, error) {
+	return sc.target()
+}
+func (sc linuxSystemService) statusAll(names []string) (map[string]Status, error) {
+	return sc.status(names)
+}
 
 func init() {
 	ChooseSystem(linuxSystemService{
@@ -37,7 +58,9 @@ func init() {
 			is, _ := isInteractive()
 			return is
 		},
-		new: newSystemdService,
+		new:    newSystemdService,
+		target: systemdTarget,
+		status: systemdStatusAll,
 	},
 		linuxSystemService{
 			name:   "linux-upstart",
@@ -46,7 +69,9 @@ func init() {
 				is, _ := isInteractive()
 				return is
 			},
-			new: newUpstartService,
+			new:    newUpstartService,
+			target: runlevel,
+			status: upstartStatusAll,
 		},
 		linuxSystemService{
 			name:   "unix-systemv",
@@ -55,11 +80,19 @@ func init() {
 				is, _ := isInteractive()
 				return is
 			},
-			new: newSystemVService,
+			new:    newSystemVService,
+			target: runlevel,
+			status: sysvStatusAll,
 		},
 	)
 }
 
+// dupTo makes newfd a copy of oldfd.
+func dupTo(oldfd, newfd int) error {
+	// Dup2 is missing on some architectures, such as arm64.
+	return syscall.Dup3(oldfd, newfd, 0)
+}
+
 func isInteractive() (bool, error) {
 	// TODO: This is not true for user services.
 	return os.Getppid() != 1, nil
@@ -72,4 +105,389 @@ var tf = map[string]interface{}{
 	"cmdEscape": func(s string) string {
 		return strings.Replace(s, " ", `\x20`, -1)
 	},
+	"shellQuote": shellQuote,
+}
+
+// shellQuote quotes s as a single word for a POSIX shell.
+func shellQuote(s string) string {
+	return `'` + strings.Replace(s, `'`, `'\''`, -1) + `'`
+}
+
+// readPrefixedLine returns the rest of the first line in the file at path
+// that starts with prefix, ignoring leading whitespace.
+func readPrefixedLine(path, prefix string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix), nil
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("No %q line in %s.", prefix, path)
+}
+
+// shellUnquote reverses shellQuote. Unquoted words are returned unchanged.
+func shellUnquote(s string) string {
+	if len(s) < 2 || s[0] != '\'' || s[len(s)-1] != '\'' {
+		return s
+	}
+	return strings.Replace(s[1:len(s)-1], `'\''`, `'`, -1)
+}
+
+// seconds returns d in whole seconds, rounded up.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// runlevel returns the current runlevel as reported by the runlevel command,
+// which prints the previous and the current runlevel.
+func runlevel() (string, error) {
+	out, err := runWithOutput("runlevel")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return "", fmt.Errorf("Unexpected runlevel output %q.", out)
+	}
+	return fields[1], nil
+}
+
+// ioScheduling reads the IO scheduling options. priority is -1 if unset.
+func ioScheduling(kv KeyValue) (class string, priority int, err error) {
+	class, err = kv.oneOf(optionIOSchedulingClass, "", "", "realtime", "best-effort", "idle")
+	if err != nil {
+		return "", 0, err
+	}
+	priority = -1
+	if _, found := kv[optionIOSchedulingPriority]; found {
+		priority = kv.int(optionIOSchedulingPriority, -1)
+		if priority < 0 || priority > 7 {
+			return "", 0, fmt.Errorf("%s must be an int from 0 to 7.", optionIOSchedulingPriority)
+		}
+		if class == "idle" {
+			return "", 0, fmt.Errorf("%s cannot be used with the idle IO scheduling class.", optionIOSchedulingPriority)
+		}
+	}
+	return class, priority, nil
+}
+
+// ioprioClasses maps IO scheduling classes to the kernel IOPRIO_CLASS values.
+var ioprioClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupLimitRe matches cgroup interface files such as memory.max.
+var cgroupLimitRe = regexp.MustCompile(`^[a-z]+\.[a-z.]+$`)
+
+// joinCGroup moves the process into the group <CGroupParent>/<name> below
+// root, creating it and writing the CGroupLimits and IOWeight into it.
+func joinCGroup(root, name string, kv KeyValue) error {
+	parent := kv.string(optionCGroupParent, "")
+	if len(parent) == 0 {
+		return nil
+	}
+	limits := map[string]string{}
+	m, _ := kv[optionCGroupLimits].(map[string]string)
+	for file, value := range m {
+		if !cgroupLimitRe.MatchString(file) || strings.HasPrefix(file, "cgroup.") {
+			return fmt.Errorf("%s file %q is not a controller interface file.", optionCGroupLimits, file)
+		}
+		limits[file] = value
+	}
+	if _, found := kv[optionIOWeight]; found {
+		w := kv.int(optionIOWeight, 0)
+		if w < 1 || w > 10000 {
+			return fmt.Errorf("%s must be an int from 1 to 10000.", optionIOWeight)
+		}
+		limits["io.weight"] = strconv.Itoa(w)
+	}
+
+	// Each ancestor must enable the controllers for its children.
+	controllers := map[string]bool{}
+	for file := range limits {
+		controllers[file[:strings.IndexByte(file, '.')]] = true
+	}
+	rel := strings.Trim(filepath.Clean("/"+parent), "/")
+	dir := filepath.Join(root, rel, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	ancestor := root
+	for _, elem := range append(strings.Split(rel, "/"), "") {
+		for c := range controllers {
+			if err := ioutil.WriteFile(filepath.Join(ancestor, "cgroup.subtree_control"), []byte("+"+c), 0644); err != nil {
+				return fmt.Errorf("Enable %s controller in %s: %v", c, ancestor, err)
+			}
+		}
+		ancestor = filepath.Join(ancestor, elem)
+	}
+
+	files := make([]string, 0, len(limits))
+	for file := range limits {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(limits[file]), 0644); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644)
+}
+
+// setIOScheduling applies the IO scheduling options to every thread of the
+// process with ioprio_set. Threads created later inherit the priority.
+// The realtime class requires CAP_SYS_ADMIN.
+func setIOScheduling(kv KeyValue) error {
+	class, priority, err := ioScheduling(kv)
+	if err != nil || (len(class) == 0 && priority < 0) {
+		return err
+	}
+	if len(class) == 0 {
+		class = "best-effort"
+	}
+	if priority < 0 {
+		priority = 4
+	}
+	if class == "idle" {
+		priority = 0
+	}
+	const ioprioWhoProcess, ioprioClassShift = 1, 13
+	ioprio := ioprioClasses[class]<<ioprioClassShift | priority
+
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio))
+		if errno != 0 && errno != syscall.ESRCH {
+			return fmt.Errorf("ioprio_set failed: %v", errno)
+		}
+	}
+	return nil
+}
+
+// procListening returns the sockets the process pid listens on, found by
+// matching the socket inodes of its open files against /proc/<pid>/net.
+func procListening(pid int) ([]string, error) {
+	dir := fmt.Sprintf("/proc/%d", pid)
+	fds, err := ioutil.ReadDir(dir + "/fd")
+	if err != nil {
+		return nil, err
+	}
+	inodes := make(map[string]bool, len(fds))
+	for _, fd := range fds {
+		link, err := os.Readlink(dir + "/fd/" + fd.Name())
+		if err == nil && strings.HasPrefix(link, "socket:[") {
+			inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = true
+		}
+	}
+
+	var ports []string
+	for _, table := range []struct {
+		file, proto, state string
+	}{
+		// TCP_LISTEN and, for UDP, TCP_CLOSE which is an unconnected socket.
+		{"tcp", "tcp", "0A"},
+		{"tcp6", "tcp", "0A"},
+		{"udp", "udp", "07"},
+		{"udp6", "udp", "07"},
+	} {
+		lines, err := procNetLines(dir + "/net/" + table.file)
+		if err != nil {
+			continue
+		}
+		for _, f := range lines {
+			if len(f) < 10 || f[3] != table.state || !inodes[f[9]] {
+				continue
+			}
+			if addr, ok := procNetAddr(f[1]); ok {
+				ports = append(ports, table.proto+":"+addr)
+			}
+		}
+	}
+	lines, err := procNetLines(dir + "/net/unix")
+	if err == nil {
+		for _, f := range lines {
+			// Fields are Num RefCount Protocol Flags Type St Inode Path;
+			// St 01 is listening.
+			if len(f) >= 8 && f[5] == "01" && inodes[f[6]] {
+				ports = append(ports, "unix:"+f[7])
+			}
+		}
+	}
+	return ports, nil
+}
+
+// procNetLines returns the fields of each line of a /proc/net table,
+// without the header.
+func procNetLines(path string) ([][]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	fields := make([][]string, 0, len(lines))
+	for _, line := range lines[1:] {
+		fields = append(fields, strings.Fields(line))
+	}
+	return fields, nil
+}
+
+// procNetAddr decodes an address such as 0100007F:1F90 from /proc/net/tcp.
+// The IP is in words of four bytes in host order, the port is big-endian.
+func procNetAddr(s string) (string, bool) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return "", false
+	}
+	raw, err := hex.DecodeString(s[:i])
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return "", false
+	}
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return "", false
+	}
+	ip := make(net.IP, len(raw))
+	for w := 0; w < len(raw); w += 4 {
+		word := binary.LittleEndian.Uint32(raw[w:])
+		binary.BigEndian.PutUint32(ip[w:], word)
+	}
+	return net.JoinHostPort(ip.String(), strconv.FormatUint(port, 10)), true
+}
+
+// supplementaryGroups returns the SupplementaryGroups option after checking
+// that the groups exist.
+func supplementaryGroups(kv KeyValue) ([]string, error) {
+	groups := kv.strings(optionSupplementaryGroups, nil)
+	for _, g := range groups {
+		if _, err := user.LookupGroup(g); err != nil {
+			return nil, fmt.Errorf("%s: %v", optionSupplementaryGroups, err)
+		}
+	}
+	return groups, nil
+}
+
+// setprivPrefix returns the setpriv command that runs a program in the
+// SupplementaryGroups, as userName if it is set, followed by a space.
+// It is empty without SupplementaryGroups.
+func setprivPrefix(kv KeyValue, userName string) (string, error) {
+	groups, err := supplementaryGroups(kv)
+	if err != nil || len(groups) == 0 {
+		return "", err
+	}
+	args := []string{"setpriv"}
+	if len(userName) != 0 {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "--reuid="+u.Uid, "--regid="+u.Gid)
+	}
+	args = append(args, "--groups="+strings.Join(groups, ","), "--")
+	for i, a := range args {
+		args[i] = shellQuote(a)
+	}
+	return strings.Join(args, " ") + " ", nil
+}
+
+// clockTicks is the unit of the times in /proc/<pid>/stat, USER_HZ, which
+// is 100 on all architectures Linux supports.
+const clockTicks = 100
+
+// procUsage reads the resident memory and processor time of the process
+// pid from /proc.
+func procUsage(pid int) (ResourceUsage, error) {
+	var u ResourceUsage
+	dir := fmt.Sprintf("/proc/%d", pid)
+	b, err := ioutil.ReadFile(dir + "/stat")
+	if err != nil {
+		return u, err
+	}
+	// The command name in parentheses may hold spaces; the fields after it
+	// start with the state, field 3, so utime and stime are 11 and 12.
+	stat := string(b)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 13 {
+		return u, fmt.Errorf("%s/stat has %d fields.", dir, len(fields))
+	}
+	for _, f := range fields[11:13] {
+		ticks, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return u, err
+		}
+		u.CPU += time.Duration(ticks) * time.Second / clockTicks
+	}
+	b, err = ioutil.ReadFile(dir + "/statm")
+	if err != nil {
+		return u, err
+	}
+	fields = strings.Fields(string(b))
+	if len(fields) < 2 {
+		return u, fmt.Errorf("%s/statm has %d fields.", dir, len(fields))
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return u, err
+	}
+	u.Memory = pages * uint64(os.Getpagesize())
+	return u, nil
+}
+
+// procStartTime reads when the process pid started from /proc. Its stat
+// holds the start in clock ticks after boot, field 22, and /proc/stat
+// the boot time.
+func procStartTime(pid int) (time.Time, error) {
+	path := fmt.Sprintf("/proc/%d/stat", pid)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	stat := string(b)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("%s has %d fields.", path, len(fields))
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	btime, err := readPrefixedLine("/proc/stat", "btime ")
+	if err != nil {
+		return time.Time{}, err
+	}
+	boot, err := strconv.ParseInt(btime, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(boot, 0).Add(time.Duration(ticks) * time.Second / clockTicks), nil
+}
+
+// readPIDFile reads the process ID written to path.
+func readPIDFile(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
 }
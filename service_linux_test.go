@@ -0,0 +1,645 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"log/syslog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShellQuote(t *testing.T) {
+	for _, arg := range []string{"/opt/My App/bin/myd", "it's", `"$HOME" \n`, ""} {
+		out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(arg)).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != arg {
+			t.Errorf("shellQuote(%q) read back as %q", arg, out)
+		}
+		if got := shellUnquote(shellQuote(arg)); got != arg {
+			t.Errorf("shellUnquote(shellQuote(%q)) = %q", arg, got)
+		}
+	}
+}
+
+func TestSysVSpacedPath(t *testing.T) {
+	s := &sysv{Config: &Config{
+		Name:             "myd",
+		WorkingDirectory: "/var/lib/My App",
+		Arguments:        []string{"-config", "/etc/My App/myd.conf"},
+	}}
+	var buf bytes.Buffer
+	if err := s.render(&buf, "/opt/My App/bin/myd"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`cd '/var/lib/My App'`,
+		`'/opt/My App/bin/myd' '-config' '/etc/My App/myd.conf' >>`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("init script missing %q:\n%s", want, buf.String())
+		}
+	}
+	if out, err := exec.Command("sh", "-n", "-c", buf.String()).CombinedOutput(); err != nil {
+		t.Errorf("init script syntax: %v: %s", err, out)
+	}
+}
+
+func TestUpstartSpacedPath(t *testing.T) {
+	s := &upstart{Config: &Config{
+		Name:      "myd",
+		Arguments: []string{"-config", "/etc/My App/myd.conf"},
+	}}
+	var buf bytes.Buffer
+	if err := s.render(&buf, "/opt/My App/bin/myd", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`test -x '/opt/My App/bin/myd'`,
+		`exec '/opt/My App/bin/myd' '-config' '/etc/My App/myd.conf'`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("upstart job missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestUpstartNormalExit(t *testing.T) {
+	s := &upstart{Config: &Config{Name: "myd", Option: KeyValue{}}}
+	for clean, want := range map[bool]bool{false: true, true: false} {
+		s.Option[optionRestartOnCleanExit] = clean
+		var buf bytes.Buffer
+		if err := s.render(&buf, "/usr/bin/myd", true); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(buf.String(), "normal exit 0 TERM INT\n"); got != want {
+			t.Errorf("RestartOnCleanExit %v: normal exit stanza %v, want %v:\n%s", clean, got, want, buf.String())
+		}
+	}
+}
+
+func TestUpstartExec(t *testing.T) {
+	r := &recordRunner{}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	s := &upstart{Config: &Config{Name: "myd"}}
+	if _, err := Exec(s, "status"); err != nil {
+		t.Error(err)
+	}
+	for _, verb := range []string{"emit", "log-priority", "reload-configuration", "list"} {
+		if _, err := Exec(s, verb); err == nil {
+			t.Errorf("Exec(%s) accepted", verb)
+		}
+	}
+	if want := "initctl status myd"; strings.Join(r.commands, ",") != want {
+		t.Errorf("commands = %q, want %q", r.commands, want)
+	}
+}
+
+func TestRunCombined(t *testing.T) {
+	out, err := runCombined("sh", "-c", "echo out; echo err >&2; exit 3")
+	if err == nil {
+		t.Error("failing command returned no error")
+	}
+	if out != "out\nerr\n" {
+		t.Errorf("output = %q, want stdout and stderr", out)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicewatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "myd.conf")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	changed := watchConfig([]string{path}, 10*time.Millisecond, stop)
+
+	for i := 0; i < 3; i++ {
+		if err := ioutil.WriteFile(path, bytes.Repeat([]byte("x"), i+1), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change not reported")
+	}
+	select {
+	case <-changed:
+		t.Error("one change reported twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReraiseConfigChanged(t *testing.T) {
+	c := &Config{Name: "myd"}
+	if err := reraise(c, configChanged, nil); err != errConfigChanged {
+		t.Errorf("reraise after config change = %v, want %v", err, errConfigChanged)
+	}
+	stopErr := errors.New("stop failed")
+	if err := reraise(c, configChanged, stopErr); err != stopErr {
+		t.Errorf("reraise with Stop error = %v, want %v", err, stopErr)
+	}
+}
+
+func TestProcListening(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	want := "tcp:" + l.Addr().String()
+
+	ports, err := procListening(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range ports {
+		if p == want {
+			return
+		}
+	}
+	t.Errorf("procListening(%d) = %v, want %q", os.Getpid(), ports, want)
+}
+
+func TestOrderSystems(t *testing.T) {
+	systems := AvailableSystems()
+	ordered, err := orderSystems(systems, []string{"unix-systemv", "linux-upstart"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range ordered {
+		names = append(names, s.String())
+	}
+	if got := strings.Join(names, ","); got != "unix-systemv,linux-upstart,linux-systemd" {
+		t.Errorf("order = %s", got)
+	}
+	if _, err := orderSystems(systems, []string{"openrc"}); err == nil {
+		t.Error("unknown system accepted")
+	}
+}
+
+func TestListeners(t *testing.T) {
+	if os.Getenv("SERVICE_TEST_LISTENERS") == "1" {
+		listeners, err := Listeners()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"http", "metrics"} {
+			for _, l := range listeners[name] {
+				fmt.Printf("%s=%s\n", name, l.Addr())
+			}
+		}
+		return
+	}
+
+	var files []*os.File
+	var want []string
+	for _, name := range []string{"http", "http", "metrics"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		want = append(want, name+"="+l.Addr().String())
+	}
+	// exec keeps the PID of the shell, so LISTEN_PID matches the test binary.
+	cmd := exec.Command("sh", "-c", `LISTEN_PID=$$ exec "$0" -test.run=^TestListeners$`, os.Args[0])
+	cmd.Env = append(os.Environ(), "SERVICE_TEST_LISTENERS=1", "LISTEN_FDS=3", "LISTEN_FDNAMES=http:http:metrics")
+	cmd.ExtraFiles = files
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	for _, w := range want {
+		if !strings.Contains(string(out), w+"\n") {
+			t.Errorf("output missing %q:\n%s", w, out)
+		}
+	}
+}
+
+func TestProcUsage(t *testing.T) {
+	u, err := procUsage(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Memory == 0 {
+		t.Errorf("procUsage() = %+v, want resident memory", u)
+	}
+}
+
+func TestSupplementaryGroups(t *testing.T) {
+	opt := KeyValue{optionSupplementaryGroups: []string{"root"}}
+	var buf bytes.Buffer
+	if err := (&sysv{Config: &Config{Name: "myd", Option: opt}}).render(&buf, "/usr/bin/myd"); err != nil {
+		t.Fatal(err)
+	}
+	if want := `'setpriv' '--groups=root' '--' '/usr/bin/myd' >>`; !strings.Contains(buf.String(), want) {
+		t.Errorf("init script missing %q:\n%s", want, buf.String())
+	}
+
+	buf.Reset()
+	if err := (&upstart{Config: &Config{Name: "myd", UserName: "root", Option: opt}}).render(&buf, "/usr/bin/myd", true); err != nil {
+		t.Fatal(err)
+	}
+	if want := `exec 'setpriv' '--reuid=0' '--regid=0' '--groups=root' '--' '/usr/bin/myd'`; !strings.Contains(buf.String(), want) {
+		t.Errorf("upstart job missing %q:\n%s", want, buf.String())
+	}
+	if strings.Contains(buf.String(), "setuid") {
+		t.Errorf("upstart job with setpriv must not setuid:\n%s", buf.String())
+	}
+
+	if _, err := supplementaryGroups(KeyValue{optionSupplementaryGroups: []string{"no-such-group-myd"}}); err == nil {
+		t.Error("unknown group accepted")
+	}
+}
+
+func TestExecutableByOS(t *testing.T) {
+	c := &Config{Executable: "/usr/bin/fallback", Option: KeyValue{
+		optionInstallPrefix: "/opt/myd",
+		optionExecutableByOS: map[string]string{
+			"linux":   "${PREFIX}/bin/myd",
+			"windows": `C:\Program Files\MyD\myd.exe`,
+		},
+	}}
+	if got := c.executable(); got != "/opt/myd/bin/myd" {
+		t.Errorf("executable() = %q", got)
+	}
+	delete(c.Option[optionExecutableByOS].(map[string]string), "linux")
+	if got := c.executable(); got != "/usr/bin/fallback" {
+		t.Errorf("executable() without linux = %q", got)
+	}
+}
+
+func TestReraiseSignal(t *testing.T) {
+	if os.Getenv("SERVICE_TEST_RERAISE") == "1" {
+		signal.Notify(make(chan os.Signal, 1), syscall.SIGTERM)
+		reraise(&Config{Option: KeyValue{optionReraiseSignal: true}}, syscall.SIGTERM, nil)
+		os.Exit(0)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestReraiseSignal$")
+	cmd.Env = append(os.Environ(), "SERVICE_TEST_RERAISE=1")
+	err := cmd.Run()
+	exit, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("child exited with %v, want SIGTERM", err)
+	}
+	if ws := exit.Sys().(syscall.WaitStatus); !ws.Signaled() || ws.Signal() != syscall.SIGTERM {
+		t.Errorf("child exited with %v, want SIGTERM", err)
+	}
+}
+
+func TestLogIdentifierByLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicesyslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "log")
+	conn, err := net.ListenPacket("unixgram", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	defer func(f func(string, string, string) (*syslog.Writer, error)) { syslogNew = f }(syslogNew)
+	syslogNew = func(network, raddr, tag string) (*syslog.Writer, error) {
+		return syslog.Dial("unixgram", sock, syslog.LOG_INFO, tag)
+	}
+
+	l, err := newSysLogger("myd", KeyValue{optionLogIdentifierByLevel: map[string]string{"error": "myd-alert"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		log  func(...interface{}) error
+		want string
+	}{
+		{l.Error, " myd-alert["},
+		{l.Warning, " myd["},
+		{l.Info, " myd["},
+	} {
+		if err = c.log("hello"); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg := string(buf[:n]); !strings.Contains(msg, c.want) {
+			t.Errorf("message %q not tagged %q", msg, c.want)
+		}
+	}
+
+	if err = l.(io.Closer).Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	if _, err = newSysLogger("myd", KeyValue{optionLogIdentifierByLevel: map[string]string{"debug": "x"}}, nil); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
+
+func TestSyslogAddress(t *testing.T) {
+	for addr, want := range map[string]string{
+		"":                        "",
+		"udp://logs.example":      "udp logs.example:514",
+		"tcp://10.0.0.5:6514":     "tcp 10.0.0.5:6514",
+		"udp6://[2001:db8::1]":    "udp6 [2001:db8::1]:514",
+		"http://logs.example:514": "error",
+		"udp://logs.example/x":    "error",
+	} {
+		network, raddr, err := syslogAddress(KeyValue{optionSyslogAddress: addr})
+		got := strings.TrimSpace(network + " " + raddr)
+		if err != nil {
+			got = "error"
+		}
+		if got != want {
+			t.Errorf("syslogAddress(%q) = %q, want %q", addr, got, want)
+		}
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	l, err := newSysLogger("myd", KeyValue{optionSyslogAddress: "udp://" + conn.LocalAddr().String()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Info("hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := string(buf[:n]); !strings.Contains(msg, " myd[") || !strings.HasSuffix(strings.TrimSpace(msg), "hello") {
+		t.Errorf("message %q", msg)
+	}
+}
+
+type nopProgram struct{ startErr error }
+
+func (p nopProgram) Start(s Service) error { return p.startErr }
+func (p nopProgram) Stop(s Service) error  { return nil }
+
+func TestOnStateChange(t *testing.T) {
+	var got []string
+	opt := KeyValue{
+		optionRunWait: func() {},
+		optionOnStateChange: func(from, to State) {
+			got = append(got, from.String()+"->"+to.String())
+		},
+	}
+	s := &sysv{i: nopProgram{}, Config: &Config{Name: "myd", Option: opt}}
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	want := "stopped->starting,starting->running,running->stopping,stopping->stopped"
+	if strings.Join(got, ",") != want {
+		t.Errorf("transitions = %q, want %q", got, want)
+	}
+
+	got = nil
+	s.i = nopProgram{startErr: fmt.Errorf("no port")}
+	if err := s.Run(); err == nil {
+		t.Fatal("Run succeeded with failing Start")
+	}
+	if want = "stopped->starting,starting->stopped"; strings.Join(got, ",") != want {
+		t.Errorf("transitions = %q, want %q", got, want)
+	}
+}
+
+func TestUnmanagedSignals(t *testing.T) {
+	stop := make(chan struct{})
+	s := &sysv{i: nopProgram{}, Config: &Config{Name: "myd", Option: KeyValue{
+		optionManageSignals: false,
+		optionStopChannel:   stop,
+	}}}
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned before StopChannel closed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(stop)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after StopChannel closed")
+	}
+
+	if _, err := New(nopProgram{}, &Config{Name: "myd", Option: KeyValue{optionManageSignals: false}}); err != errNoStopChannel {
+		t.Errorf("New without StopChannel: err = %v, want %v", err, errNoStopChannel)
+	}
+}
+
+func TestProcStartTime(t *testing.T) {
+	at, err := procStartTime(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The test binary started shortly before the test; allow for clock
+	// tick rounding.
+	if d := time.Since(at); d < -time.Second || d > time.Hour {
+		t.Errorf("procStartTime() = %v, %v ago", at, d)
+	}
+}
+
+func TestJoinCGroup(t *testing.T) {
+	root, err := ioutil.TempDir("", "servicecgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	err = joinCGroup(root, "myd", KeyValue{
+		optionCGroupParent: "apps/web",
+		optionCGroupLimits: map[string]string{"memory.max": "512M"},
+		optionIOWeight:     200,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{
+		"apps/web/myd/memory.max":   "512M",
+		"apps/web/myd/io.weight":    "200",
+		"apps/web/myd/cgroup.procs": fmt.Sprint(os.Getpid()),
+	} {
+		if b, err := ioutil.ReadFile(filepath.Join(root, file)); err != nil || string(b) != want {
+			t.Errorf("%s = %q, %v, want %q", file, b, err, want)
+		}
+	}
+	for _, dir := range []string{"", "apps", "apps/web"} {
+		if _, err := os.Stat(filepath.Join(root, dir, "cgroup.subtree_control")); err != nil {
+			t.Errorf("controllers not enabled in %q: %v", dir, err)
+		}
+	}
+
+	err = joinCGroup(root, "myd", KeyValue{
+		optionCGroupParent: "apps",
+		optionCGroupLimits: map[string]string{"cgroup.procs": "1"},
+	})
+	if err == nil {
+		t.Error("CGroupLimits cgroup.procs accepted")
+	}
+}
+
+func TestLaunchctlStderr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicepath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := "#!/bin/sh\necho warning >&2\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "launchctl"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	if _, err = (execRunner{}).Run(context.Background(), "launchctl", "list"); err != nil {
+		t.Errorf("list with stderr failed: %v", err)
+	}
+	if _, err = (execRunner{}).Run(context.Background(), "launchctl", "load", "/tmp/myd.plist"); err == nil {
+		t.Error("load with stderr succeeded")
+	}
+}
+
+func TestResolveSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicelink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "myd-1.2")
+	if err = ioutil.WriteFile(target, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "myd")
+	if err = os.Symlink("myd-1.2", link); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		option KeyValue
+		path   string
+		want   string
+	}{
+		{KeyValue{}, link, target},
+		{KeyValue{}, "myd", target},
+		{KeyValue{optionPreserveSymlink: true}, link, link},
+		{KeyValue{}, filepath.Join(dir, "missing"), filepath.Join(dir, "missing")},
+		{KeyValue{}, "missing", filepath.Join(dir, "missing")},
+	} {
+		got, err := (&Config{Option: c.option}).resolveSymlinks(c.path)
+		if err != nil || got != c.want {
+			t.Errorf("options %v: resolveSymlinks(%q) = %q, %v, want %q", c.option, c.path, got, err, c.want)
+		}
+	}
+}
+
+// lineLogger records the lines logged to it.
+type lineLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *lineLogger) add(v ...interface{}) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprint(v...))
+	return nil
+}
+func (l *lineLogger) Error(v ...interface{}) error {
+	return l.add(append([]interface{}{"E: "}, v...)...)
+}
+func (l *lineLogger) Warning(v ...interface{}) error {
+	return l.add(append([]interface{}{"W: "}, v...)...)
+}
+func (l *lineLogger) Info(v ...interface{}) error {
+	return l.add(append([]interface{}{"I: "}, v...)...)
+}
+func (l *lineLogger) Errorf(format string, a ...interface{}) error {
+	return l.Error(fmt.Sprintf(format, a...))
+}
+func (l *lineLogger) Warningf(format string, a ...interface{}) error {
+	return l.Warning(fmt.Sprintf(format, a...))
+}
+func (l *lineLogger) Infof(format string, a ...interface{}) error {
+	return l.Info(fmt.Sprintf(format, a...))
+}
+
+func TestCaptureOutput(t *testing.T) {
+	l := &lineLogger{}
+	restore, err := captureOutput(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println("to stdout")
+	log.Print("from log")
+	syscall.Write(2, []byte("to fd 2\n"))
+	restore()
+
+	got := strings.Join(l.lines, "\n")
+	for _, want := range []string{"I: to stdout", "from log", "E: to fd 2"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("captured lines missing %q:\n%s", want, got)
+		}
+	}
+	if _, err = fmt.Fprintln(os.Stderr, "after restore"); err != nil {
+		t.Error(err)
+	}
+	if strings.Contains(strings.Join(l.lines, "\n"), "after restore") {
+		t.Error("output captured after restore")
+	}
+}
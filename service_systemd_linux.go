@@ -5,12 +5,27 @@
 package service
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
 	"os"
-	"os/signal"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"text/template"
+	"time"
 )
 
 func isSystemd() bool {
@@ -20,12 +35,107 @@ func isSystemd() bool {
 	return false
 }
 
+// systemdTarget returns the default target if it is active. Otherwise, as
+// when booted into rescue mode, it returns the first active standard target.
+func systemdTarget() (string, error) {
+	out, err := runWithOutput("systemctl", "get-default")
+	if err != nil {
+		return "", err
+	}
+	targets := []string{strings.TrimSpace(out), "graphical.target", "multi-user.target", "rescue.target", "emergency.target"}
+	for _, target := range targets {
+		if err := run("systemctl", "is-active", "--quiet", target); err == nil {
+			return target, nil
+		}
+	}
+	return "", errors.New("No active systemd target found.")
+}
+
+// systemctlShow runs systemctl show for units, of the user manager if user
+// is set, and returns one property map per unit, in the order of units.
+func systemctlShow(user bool, properties []string, units ...string) ([]map[string]string, error) {
+	args := append([]string{"show", "--property=" + strings.Join(properties, ","), "--"}, units...)
+	if user {
+		args = append([]string{"--user"}, args...)
+	}
+	out, err := runWithOutput("systemctl", args...)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []map[string]string
+	for _, block := range strings.Split(strings.TrimSpace(out), "\n\n") {
+		props := make(map[string]string)
+		for _, line := range strings.Split(block, "\n") {
+			if i := strings.IndexByte(line, '='); i > 0 {
+				props[line[:i]] = line[i+1:]
+			}
+		}
+		blocks = append(blocks, props)
+	}
+	if len(blocks) != len(units) {
+		return nil, fmt.Errorf("systemctl show returned %d units, expected %d.", len(blocks), len(units))
+	}
+	return blocks, nil
+}
+
+// systemdStatus converts the ActiveState of a unit to a Status.
+func systemdStatus(activeState string) Status {
+	switch activeState {
+	case "active", "reloading":
+		return StatusRunning
+	case "inactive", "failed":
+		return StatusStopped
+	}
+	return StatusUnknown
+}
+
+// systemdStatusAll reads the status of all units with one systemctl call.
+func systemdStatusAll(names []string) (map[string]Status, error) {
+	units := make([]string, len(names))
+	for i, name := range names {
+		units[i] = name + ".service"
+	}
+	blocks, err := systemctlShow(false, []string{"LoadState", "ActiveState"}, units...)
+	if err != nil {
+		return nil, err
+	}
+	status := make(map[string]Status, len(names))
+	for i, props := range blocks {
+		if props["LoadState"] == "not-found" {
+			continue
+		}
+		status[names[i]] = systemdStatus(props["ActiveState"])
+	}
+	return status, nil
+}
+
 type systemd struct {
 	i Interface
 	*Config
 }
 
+// systemdIsInit reports whether systemd is PID 1, reading proc, normally
+// /proc. systemd names itself systemd even when started as /sbin/init.
+func systemdIsInit(proc string) bool {
+	comm, err := ioutil.ReadFile(filepath.Join(proc, "1", "comm"))
+	return err == nil && strings.TrimSpace(string(comm)) == "systemd"
+}
+
+// newFallbackService creates the service for the first system after systemd
+// that is detected.
+func newFallbackService(i Interface, c *Config) (Service, error) {
+	for _, sys := range systemRegistry {
+		if sys.String() != "linux-systemd" && sys.Detect() {
+			return sys.New(i, c)
+		}
+	}
+	return nil, ErrNoServiceSystemDetected
+}
+
 func newSystemdService(i Interface, c *Config) (Service, error) {
+	if c.Option.bool(optionStrictSystemdDetection, optionStrictSystemdDetectionDefault) && !systemdIsInit("/proc") {
+		return newFallbackService(i, c)
+	}
 	s := &systemd{
 		i:      i,
 		Config: c,
@@ -34,102 +144,1399 @@ func newSystemdService(i Interface, c *Config) (Service, error) {
 	return s, nil
 }
 
-func (s *systemd) String() string {
-	if len(s.DisplayName) > 0 {
-		return s.DisplayName
+func (s *systemd) String() string {
+	if len(s.DisplayName) > 0 {
+		return s.DisplayName
+	}
+	return s.Name
+}
+
+func (s *systemd) program() Interface {
+	return s.i
+}
+
+// systemdRestartSec is the RestartSec= of the unit.
+const systemdRestartSec = 120
+
+// systemdDefaultStopTimeout is the default of DefaultTimeoutStopSec.
+const systemdDefaultStopTimeout = 90 * time.Second
+
+func (s *systemd) userService() bool {
+	return s.Option.bool(optionUserService, optionUserServiceDefault)
+}
+
+// unitDir returns the directory units are installed to.
+func (s *systemd) unitDir() (string, error) {
+	if !s.userService() {
+		return "/etc/systemd/system/", nil
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); len(dir) != 0 {
+		return dir + "/systemd/user/", nil
+	}
+	u, err := user.Current()
+	if err == nil {
+		return u.HomeDir + "/.config/systemd/user/", nil
+	}
+	if home := os.Getenv("HOME"); len(home) != 0 {
+		return home + "/.config/systemd/user/", nil
+	}
+	return "", errors.New("User home directory not found.")
+}
+
+func (s *systemd) configPath() (cp string, err error) {
+	dir, err := s.unitDir()
+	if err != nil {
+		return "", err
+	}
+	return dir + s.Config.Name + ".service", nil
+}
+
+func (s *systemd) socketPath() (string, error) {
+	dir, err := s.unitDir()
+	if err != nil {
+		return "", err
+	}
+	return dir + s.Config.Name + ".socket", nil
+}
+
+// failureNotifyUnit names the unit written for the OnFailureCommand option.
+func (s *systemd) failureNotifyUnit() string {
+	return s.Config.Name + "-failure-notify.service"
+}
+
+func (s *systemd) failureNotifyPath() (string, error) {
+	dir, err := s.unitDir()
+	if err != nil {
+		return "", err
+	}
+	return dir + s.failureNotifyUnit(), nil
+}
+
+// systemctlArgs prefixes args with --user for user services.
+func (s *systemd) systemctlArgs(args ...string) []string {
+	if s.userService() {
+		return append([]string{"--user"}, args...)
+	}
+	return args
+}
+
+func (s *systemd) systemctl(args ...string) error {
+	return run("systemctl", s.systemctlArgs(args...)...)
+}
+
+// alsoSysV reports whether the AlsoSysV wrapper is installed, which
+// user services never have.
+func (s *systemd) alsoSysV() bool {
+	return s.Option.bool(optionAlsoSysV, optionAlsoSysVDefault) && !s.userService()
+}
+
+func (s *systemd) sysvWrapperPath() string {
+	return "/etc/init.d/" + s.Config.Name
+}
+
+// installSysVWrapper writes an init script for tools that still call
+// "service <name> start". It forwards every action to systemctl.
+func (s *systemd) installSysVWrapper(to *systemdTemplateData) error {
+	wp := s.sysvWrapperPath()
+	if _, err := os.Stat(wp); err == nil {
+		return fmt.Errorf("Init already exists: %s", wp)
+	}
+	f, err := os.OpenFile(wp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.template(systemdSysVWrapper).Execute(f, to)
+}
+
+func (s *systemd) template(systemdType string) *template.Template {
+	return template.Must(template.New("").Funcs(tf).Funcs(template.FuncMap{
+		"isURI": isDocumentationURI,
+	}).Parse(systemdType))
+}
+
+// isDocumentationURI reports whether systemd accepts v in Documentation=.
+func isDocumentationURI(v string) bool {
+	for _, scheme := range []string{"http://", "https://", "file:", "info:", "man:"} {
+		if strings.HasPrefix(v, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// systemdTemplateData is rendered into the unit and socket files.
+type systemdTemplateData struct {
+	*Config
+	Path         string
+	ReloadSignal string
+	PIDFile      string
+	NotifyAccess string
+
+	Type            string
+	RemainAfterExit bool
+	Restart         string
+	BusName         string
+
+	IOSchedulingClass    string
+	IOSchedulingPriority string
+	IOWeight             int
+
+	SupplementaryGroups []string
+
+	AppArmorProfile string
+
+	RequiresMountsFor []string
+	Conflicts         []string
+
+	FixupOwnership []string
+	FixupMode      string
+
+	PassEnvironment  []string
+	UnsetEnvironment []string
+
+	Delegate string
+
+	RestartSteps       int
+	RestartMaxDelaySec int
+	StartLimitAction   string
+	CollectMode        string
+
+	ExecStartPost    []string
+	OnFailure        []string
+	OnFailureCommand []string
+
+	ProtectProc, ProcSubset string
+	PrivateNetwork          bool
+
+	ConditionArchitecture   string
+	ConditionVirtualization string
+
+	Directories []systemdDirectory
+	Accounting  []systemdAccounting
+
+	TimeoutSec     int
+	TimeoutStopSec int
+
+	UserService, SessionBus bool
+
+	DescriptionExtra []extraEntry
+}
+
+// unitNameRe matches unit names such as "myd.service" or "getty@tty1.service".
+var unitNameRe = regexp.MustCompile(`^[A-Za-z0-9:_.\\-]+(@[A-Za-z0-9:_.\\-]*)?\.(service|socket|device|mount|automount|swap|target|path|timer|slice|scope)$`)
+
+// systemdDirectory is a directory option, such as StateDirectory=.
+type systemdDirectory struct {
+	Option string
+	Names  []string
+}
+
+type systemdAccounting struct {
+	Option string
+	Value  string
+}
+
+// accountingOptions lists the accounting options in the order they render.
+var accountingOptions = []string{optionCPUAccounting, optionMemoryAccounting, optionTasksAccounting, optionIOAccounting}
+
+// accounting returns the accounting options that are set; the others are
+// left to the system default.
+func accounting(kv KeyValue) ([]systemdAccounting, error) {
+	var set []systemdAccounting
+	for _, opt := range accountingOptions {
+		v, found := kv[opt]
+		if !found {
+			continue
+		}
+		on, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a bool.", opt)
+		}
+		value := "no"
+		if on {
+			value = "yes"
+		}
+		set = append(set, systemdAccounting{opt, value})
+	}
+	return set, nil
+}
+
+// directoryOptions lists the directory options in the order they render.
+var directoryOptions = []string{optionRuntimeDirectory, optionStateDirectory, optionLogsDirectory, optionCacheDirectory}
+
+// directories validates the directory options. Names are relative to the
+// directory of their option and may not leave it.
+func (s *systemd) directories() ([]systemdDirectory, error) {
+	var dirs []systemdDirectory
+	for _, opt := range directoryOptions {
+		names := s.Option.strings(opt, nil)
+		for _, name := range names {
+			clean := filepath.Clean(name)
+			if filepath.IsAbs(name) || clean != name || clean == "." || strings.HasPrefix(clean, "..") || strings.ContainsAny(name, " \n") {
+				return nil, fmt.Errorf("%s %q must be a relative path below the directory of the option.", opt, name)
+			}
+		}
+		if len(names) != 0 {
+			dirs = append(dirs, systemdDirectory{opt, names})
+		}
+	}
+	return dirs, nil
+}
+
+// directoryRoot returns the directory that names of a directory option are
+// relative to.
+func (s *systemd) directoryRoot(option string) (string, error) {
+	if !s.userService() {
+		return map[string]string{
+			optionRuntimeDirectory: "/run",
+			optionStateDirectory:   "/var/lib",
+			optionLogsDirectory:    "/var/log",
+			optionCacheDirectory:   "/var/cache",
+		}[option], nil
+	}
+	if option == optionRuntimeDirectory {
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); len(dir) != 0 {
+			return dir, nil
+		}
+		return "", errors.New("XDG_RUNTIME_DIR is not set.")
+	}
+	home := os.Getenv("HOME")
+	if u, err := user.Current(); err == nil {
+		home = u.HomeDir
+	}
+	if len(home) == 0 {
+		return "", errors.New("User home directory not found.")
+	}
+	state := os.Getenv("XDG_STATE_HOME")
+	if len(state) == 0 {
+		state = home + "/.local/state"
+	}
+	switch option {
+	case optionStateDirectory:
+		return state, nil
+	case optionLogsDirectory:
+		return state + "/log", nil
+	}
+	if cache := os.Getenv("XDG_CACHE_HOME"); len(cache) != 0 {
+		return cache, nil
+	}
+	return home + "/.cache", nil
+}
+
+// purgeData removes the directories of the directory options. Each path is
+// checked to be below its root again right before removal.
+func (s *systemd) purgeData() error {
+	dirs, err := s.directories()
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		root, err := s.directoryRoot(d.Option)
+		if err != nil {
+			return err
+		}
+		for _, name := range d.Names {
+			p := filepath.Join(root, name)
+			if len(root) < 2 || !strings.HasPrefix(p, root+"/") {
+				return fmt.Errorf("Refusing to remove %s.", p)
+			}
+			s.progress("removing " + p)
+			if err = os.RemoveAll(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// startLimitActions lists the values of StartLimitAction=.
+var startLimitActions = []string{
+	"none",
+	"reboot", "reboot-force", "reboot-immediate",
+	"poweroff", "poweroff-force", "poweroff-immediate",
+	"exit", "exit-force",
+	"soft-reboot", "soft-reboot-force",
+	"kexec", "kexec-force",
+	"halt", "halt-force", "halt-immediate",
+}
+
+// conditionArchitectures lists the values of ConditionArchitecture=.
+var conditionArchitectures = map[string]bool{
+	"native": true, "x86": true, "x86-64": true, "ia64": true,
+	"arm": true, "arm-be": true, "arm64": true, "arm64-be": true,
+	"ppc": true, "ppc-le": true, "ppc64": true, "ppc64-le": true,
+	"mips": true, "mips-le": true, "mips64": true, "mips64-le": true,
+	"riscv32": true, "riscv64": true, "loongarch64": true,
+	"s390": true, "s390x": true, "sparc": true, "sparc64": true,
+	"parisc": true, "parisc64": true, "alpha": true, "sh": true, "sh64": true,
+	"m68k": true, "tilegx": true, "cris": true, "arc": true, "arc-be": true,
+}
+
+// conditionVirtualizations lists the values of ConditionVirtualization=.
+var conditionVirtualizations = map[string]bool{
+	"yes": true, "no": true, "vm": true, "container": true, "private-users": true,
+	"qemu": true, "kvm": true, "amazon": true, "zvm": true, "vmware": true,
+	"microsoft": true, "oracle": true, "powervm": true, "xen": true, "bochs": true,
+	"uml": true, "bhyve": true, "qnx": true, "acrn": true, "apple": true, "sre": true,
+	"google": true, "openvz": true, "lxc": true, "lxc-libvirt": true,
+	"systemd-nspawn": true, "docker": true, "podman": true, "rkt": true,
+	"wsl": true, "proot": true, "pouch": true,
+}
+
+// condition returns the option name if it is one of known, optionally
+// negated with a leading "!".
+func condition(kv KeyValue, name string, known map[string]bool) (string, error) {
+	value := kv.string(name, "")
+	if len(value) != 0 && !known[strings.TrimPrefix(value, "!")] {
+		return "", fmt.Errorf("Option %s is %q, which systemd does not know.", name, value)
+	}
+	return value, nil
+}
+
+// restartBackoffVersion is the first systemd with RestartSteps= and
+// RestartMaxDelaySec=.
+const restartBackoffVersion = 254
+
+// restartBackoff validates the RestartSteps and RestartMaxDelaySec options.
+// Install checks that systemd is new enough for them.
+func restartBackoff(kv KeyValue) (steps, maxDelay int, err error) {
+	_, hasSteps := kv[optionRestartSteps]
+	_, hasMaxDelay := kv[optionRestartMaxDelaySec]
+	if !hasSteps && !hasMaxDelay {
+		return 0, 0, nil
+	}
+	steps = kv.int(optionRestartSteps, 0)
+	maxDelay = kv.int(optionRestartMaxDelaySec, 0)
+	switch {
+	case hasSteps && (steps < 1 || steps > 3600):
+		return 0, 0, fmt.Errorf("%s must be an int from 1 to 3600.", optionRestartSteps)
+	case maxDelay < systemdRestartSec:
+		return 0, 0, fmt.Errorf("%s must be an int of at least %d.", optionRestartMaxDelaySec, systemdRestartSec)
+	}
+	return steps, maxDelay, nil
+}
+
+// checkRestartBackoff fails if the unit uses RestartMaxDelaySec but the
+// installed systemd is known to predate it, which would ignore it.
+func checkRestartBackoff(to *systemdTemplateData) error {
+	if to.RestartMaxDelaySec == 0 {
+		return nil
+	}
+	if v := systemdVersion(); v != 0 && v < restartBackoffVersion {
+		return fmt.Errorf("%s and %s need systemd %d, not %d.", optionRestartMaxDelaySec, optionRestartSteps, restartBackoffVersion, v)
+	}
+	return nil
+}
+
+// systemdVersion returns the version of systemctl, or 0 if unknown.
+func systemdVersion() int {
+	out, err := runWithOutput("systemctl", "--version")
+	if err != nil {
+		return 0
+	}
+	// The first line is "systemd 254 (254.5-1)".
+	fields := strings.Fields(out)
+	if len(fields) < 2 || fields[0] != "systemd" {
+		return 0
+	}
+	v, _ := strconv.Atoi(fields[1])
+	return v
+}
+
+// delegateControllers lists the controllers Delegate= accepts.
+var delegateControllers = map[string]bool{
+	"cpu":          true,
+	"cpuacct":      true,
+	"cpuset":       true,
+	"io":           true,
+	"blkio":        true,
+	"memory":       true,
+	"devices":      true,
+	"pids":         true,
+	"bpf-firewall": true,
+	"bpf-devices":  true,
+}
+
+// delegate returns the value of Delegate= for the Delegate option.
+func delegate(kv KeyValue) (string, error) {
+	switch v := kv[optionDelegate].(type) {
+	case nil:
+		return "", nil
+	case bool:
+		if v {
+			return "yes", nil
+		}
+		return "no", nil
+	case []string:
+		for _, c := range v {
+			if !delegateControllers[c] {
+				return "", fmt.Errorf("%s controller %q is not known.", optionDelegate, c)
+			}
+		}
+		return strings.Join(v, " "), nil
+	}
+	return "", fmt.Errorf("%s must be a bool or a []string.", optionDelegate)
+}
+
+// envNameRe matches environment variable names.
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// securityPresets are the defaults of the sandboxing options for each
+// SecurityPreset value.
+var securityPresets = map[string]map[string]string{
+	"strict": {
+		optionProtectProc: "invisible",
+		optionProcSubset:  "pid",
+	},
+}
+
+// busNameElementRe matches one element of a well-known D-Bus name.
+var busNameElementRe = regexp.MustCompile(`^[A-Za-z_-][A-Za-z0-9_-]*$`)
+
+// validBusName reports whether name is a well-known D-Bus name, at least
+// two dot separated elements that do not start with a digit.
+func validBusName(name string) bool {
+	elements := strings.Split(name, ".")
+	if len(name) > 255 || len(elements) < 2 {
+		return false
+	}
+	for _, e := range elements {
+		if !busNameElementRe.MatchString(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// templateData reads and validates the options rendered into the unit.
+func (s *systemd) templateData(path string) (*systemdTemplateData, error) {
+	to := &systemdTemplateData{
+		Config:       s.Config,
+		Path:         path,
+		ReloadSignal: s.Option.string(optionReloadSignal, ""),
+		PIDFile:      s.Option.string(optionPIDFile, ""),
+
+		AppArmorProfile: oneLine(s.Option.string(optionAppArmorProfile, "")),
+
+		UserService: s.userService(),
+		SessionBus:  s.Option.bool(optionSessionBus, optionSessionBusDefault),
+
+		DescriptionExtra: s.descriptionExtra(),
+	}
+	if to.SessionBus && !to.UserService {
+		return nil, fmt.Errorf("%s requires %s.", optionSessionBus, optionUserService)
+	}
+	if s.Option.bool(optionEnableLinger, optionEnableLingerDefault) && !to.UserService {
+		return nil, fmt.Errorf("%s requires %s.", optionEnableLinger, optionUserService)
+	}
+	var err error
+	to.Type, err = s.Option.oneOf(optionSystemdType, "", "", "simple", "exec", "forking", "oneshot", "notify", "dbus", "idle")
+	if err != nil {
+		return nil, err
+	}
+	if _, found := s.Option[optionNotifyAccess]; found || to.Type == "notify" {
+		to.NotifyAccess, err = s.Option.oneOf(optionNotifyAccess, optionNotifyAccessDefault, "none", "main", "exec", "all")
+		if err != nil {
+			return nil, err
+		}
+	}
+	to.BusName = s.Option.string(optionBusName, "")
+	if len(to.BusName) != 0 {
+		if !validBusName(to.BusName) {
+			return nil, fmt.Errorf("%s %q is not a well-known D-Bus name.", optionBusName, to.BusName)
+		}
+		if len(to.Type) != 0 && to.Type != "dbus" {
+			return nil, fmt.Errorf("%s requires %s dbus, not %s.", optionBusName, optionSystemdType, to.Type)
+		}
+		to.Type = "dbus"
+	}
+	to.RemainAfterExit = s.Option.bool(optionRemainAfterExit, to.Type == "oneshot")
+	if to.Type == "oneshot" {
+		to.Restart, err = s.restart("")
+		if to.Restart == "always" || to.Restart == "on-success" {
+			return nil, fmt.Errorf("%s %s is not allowed with %s oneshot.", optionRestart, to.Restart, optionSystemdType)
+		}
+	} else if s.Option.bool(optionRestartOnCleanExit, optionRestartOnCleanExitDefault) {
+		to.Restart, err = s.restart("always")
+	} else {
+		to.Restart, err = s.restart("on-failure")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	class, priority, err := ioScheduling(s.Option)
+	if err != nil {
+		return nil, err
+	}
+	to.IOSchedulingClass = class
+	if priority >= 0 {
+		to.IOSchedulingPriority = strconv.Itoa(priority)
+	}
+	to.TimeoutSec = seconds(s.Option.duration(optionTimeout, 0))
+	to.TimeoutStopSec = seconds(s.Option.duration(optionStopTimeout, 0))
+	to.RequiresMountsFor = s.Option.strings(optionRequiresMountsFor, nil)
+	for _, p := range to.RequiresMountsFor {
+		if !filepath.IsAbs(p) || strings.ContainsAny(p, "\n") {
+			return nil, fmt.Errorf("%s path %q must be absolute.", optionRequiresMountsFor, p)
+		}
+	}
+	to.Conflicts = s.Option.strings(optionConflicts, nil)
+	for _, u := range to.Conflicts {
+		if !unitNameRe.MatchString(u) {
+			return nil, fmt.Errorf("%s %q is not a unit name.", optionConflicts, u)
+		}
+	}
+	to.FixupOwnership = s.Option.strings(optionFixupOwnership, nil)
+	if len(to.FixupOwnership) != 0 {
+		if len(s.UserName) == 0 {
+			return nil, fmt.Errorf("%s requires UserName.", optionFixupOwnership)
+		}
+		for _, p := range to.FixupOwnership {
+			if !filepath.IsAbs(p) || strings.ContainsAny(p, "\n") {
+				return nil, fmt.Errorf("%s path %q must be absolute.", optionFixupOwnership, p)
+			}
+		}
+		umask := uint64(0022)
+		if len(s.UMask) != 0 {
+			umask, err = strconv.ParseUint(s.UMask, 8, 32)
+			if err != nil || umask > 0777 {
+				return nil, fmt.Errorf("UMask %q is not an octal mode.", s.UMask)
+			}
+		}
+		to.FixupMode = fmt.Sprintf("%04o", 0777&^umask)
+	}
+	for _, opt := range []struct {
+		name  string
+		value *[]string
+	}{
+		{optionPassEnvironment, &to.PassEnvironment},
+		{optionUnsetEnvironment, &to.UnsetEnvironment},
+	} {
+		*opt.value = s.Option.strings(opt.name, nil)
+		for _, v := range *opt.value {
+			if !envNameRe.MatchString(v) {
+				return nil, fmt.Errorf("%s %q is not a variable name.", opt.name, v)
+			}
+		}
+	}
+	to.StartLimitAction, err = s.Option.oneOf(optionStartLimitAction, "", append([]string{""}, startLimitActions...)...)
+	if err != nil {
+		return nil, err
+	}
+	to.ExecStartPost, err = commandOption(s.Option, optionExecStartPost)
+	if err != nil {
+		return nil, err
+	}
+	to.OnFailure = s.Option.strings(optionOnFailure, nil)
+	for _, u := range to.OnFailure {
+		if !unitNameRe.MatchString(u) {
+			return nil, fmt.Errorf("%s %q is not a unit name.", optionOnFailure, u)
+		}
+	}
+	to.OnFailureCommand, err = commandOption(s.Option, optionOnFailureCommand)
+	if err != nil {
+		return nil, err
+	}
+	if len(to.OnFailureCommand) != 0 {
+		to.OnFailure = append(to.OnFailure[:len(to.OnFailure):len(to.OnFailure)], s.failureNotifyUnit())
+	}
+	to.PrivateNetwork = s.Option.bool(optionPrivateNetwork, false)
+	to.CollectMode, err = s.Option.oneOf(optionCollectMode, "", "", "inactive", "inactive-or-failed")
+	if err != nil {
+		return nil, err
+	}
+	preset, err := s.Option.oneOf(optionSecurityPreset, "", "", "strict")
+	if err != nil {
+		return nil, err
+	}
+	defaults := securityPresets[preset]
+	to.ProtectProc, err = s.Option.oneOf(optionProtectProc, defaults[optionProtectProc], "", "noaccess", "invisible", "ptraceable", "default")
+	if err != nil {
+		return nil, err
+	}
+	to.ProcSubset, err = s.Option.oneOf(optionProcSubset, defaults[optionProcSubset], "", "all", "pid")
+	if err != nil {
+		return nil, err
+	}
+	to.ConditionArchitecture, err = condition(s.Option, optionConditionArchitecture, conditionArchitectures)
+	if err != nil {
+		return nil, err
+	}
+	to.ConditionVirtualization, err = condition(s.Option, optionConditionVirtualization, conditionVirtualizations)
+	if err != nil {
+		return nil, err
+	}
+	to.RestartSteps, to.RestartMaxDelaySec, err = restartBackoff(s.Option)
+	if err != nil {
+		return nil, err
+	}
+	to.Directories, err = s.directories()
+	if err != nil {
+		return nil, err
+	}
+	to.Accounting, err = accounting(s.Option)
+	if err != nil {
+		return nil, err
+	}
+	if fd := s.SocketFileDescriptorName; len(fd) > 255 || strings.ContainsAny(fd, ": \t\n") {
+		return nil, fmt.Errorf("SocketFileDescriptorName %q must be at most 255 characters without \":\" or spaces.", fd)
+	}
+	to.Delegate, err = delegate(s.Option)
+	if err != nil {
+		return nil, err
+	}
+	if to.SupplementaryGroups, err = supplementaryGroups(s.Option); err != nil {
+		return nil, err
+	}
+	if len(to.SupplementaryGroups) != 0 && to.UserService {
+		return nil, fmt.Errorf("%s is not supported for user services.", optionSupplementaryGroups)
+	}
+	to.IOWeight = s.Option.int(optionIOWeight, 0)
+	if _, found := s.Option[optionIOWeight]; found && (to.IOWeight < 1 || to.IOWeight > 10000) {
+		return nil, fmt.Errorf("%s must be an int from 1 to 10000.", optionIOWeight)
+	}
+	if err = to.sanitize(); err != nil {
+		return nil, err
+	}
+	return to, nil
+}
+
+// commandOption returns the command option name, such as ExecStartPost,
+// after checking that the command is an executable file.
+func commandOption(kv KeyValue, name string) ([]string, error) {
+	argv := kv.strings(name, nil)
+	if len(argv) == 0 {
+		return nil, nil
+	}
+	if !filepath.IsAbs(argv[0]) {
+		return nil, fmt.Errorf("%s command %q must be an absolute path.", name, argv[0])
+	}
+	fi, err := os.Stat(argv[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if fi.IsDir() || fi.Mode()&0111 == 0 {
+		return nil, fmt.Errorf("%s command %s is not executable.", name, argv[0])
+	}
+	return argv, nil
+}
+
+// directiveKeyRe matches directive names such as ExecStart.
+var directiveKeyRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+// sanitizeDirectiveValue checks that key=value renders as one directive and
+// returns value without surrounding whitespace, which systemd drops anyway.
+// A line break would start a new directive, and a trailing backslash would
+// continue the value on the next line.
+func sanitizeDirectiveValue(key, value string) (string, error) {
+	if !directiveKeyRe.MatchString(key) {
+		return "", fmt.Errorf("%q is not a directive name.", key)
+	}
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return "", fmt.Errorf("%s value %q must be a single line.", key, value)
+	}
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, `\`) {
+		return "", fmt.Errorf("%s value %q must not end with a backslash.", key, value)
+	}
+	return value, nil
+}
+
+// sanitize applies sanitizeDirectiveValue to the values taken from the
+// Config and its options. It copies the Config rather than change it.
+// Values that are quoted or whose spaces matter are checked but not trimmed.
+func (to *systemdTemplateData) sanitize() error {
+	c := *to.Config
+	to.Config = &c
+	var err error
+	for _, v := range []struct {
+		key   string
+		value *string
+	}{
+		{"Description", &c.Description},
+		{"WorkingDirectory", &c.WorkingDirectory},
+		{"RootDirectory", &c.ChRoot},
+		{"User", &c.UserName},
+		{"Description", &c.SocketDescription},
+		{"ListenStream", &c.SocketListenStream},
+		{"PartOf", &c.SocketPartOf},
+		{"ExecReload", &to.ReloadSignal},
+		{"PIDFile", &to.PIDFile},
+		{"AppArmorProfile", &to.AppArmorProfile},
+	} {
+		if *v.value, err = sanitizeDirectiveValue(v.key, *v.value); err != nil {
+			return err
+		}
+	}
+	for _, v := range []struct {
+		key    string
+		values []string
+	}{
+		{"EnvironmentFile", []string{c.Name}},
+		{"ExecStart", append([]string{to.Path}, c.Arguments...)},
+		{"ExecStartPost", to.ExecStartPost},
+		{"ExecStart", to.OnFailureCommand},
+		{"ExecStartPre", to.FixupOwnership},
+		{"RequiresMountsFor", to.RequiresMountsFor},
+	} {
+		for _, value := range v.values {
+			if _, err = sanitizeDirectiveValue(v.key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unitFileMode returns the UnitFileMode option and whether it was set.
+// Modes that let anyone but the owner modify the unit are refused.
+func (s *systemd) unitFileMode() (mode os.FileMode, set bool, err error) {
+	v, found := s.Option[optionUnitFileMode]
+	if !found {
+		return 0, false, nil
+	}
+	switch m := v.(type) {
+	case int:
+		mode = os.FileMode(m)
+	case os.FileMode:
+		mode = m
+	default:
+		return 0, false, fmt.Errorf("%s must be an int or os.FileMode, not %T.", optionUnitFileMode, v)
+	}
+	if mode&^0777 != 0 || mode&0022 != 0 {
+		return 0, false, fmt.Errorf("%s %#o must be permission bits without group or other write.", optionUnitFileMode, mode)
+	}
+	return mode, true, nil
+}
+
+// Unit files whose commands look like they carry a secret are written with
+// secretUnitFileMode and secretUnitFileGroup unless UnitFileMode is set, so
+// journal readers can still read them but other users cannot.
+const (
+	secretUnitFileMode  = 0640
+	secretUnitFileGroup = "systemd-journal"
+)
+
+// secretNameRe matches names, such as -password or DB_TOKEN, that usually
+// precede a secret.
+var secretNameRe = regexp.MustCompile(`(?i)passw(or)?d|secret|token|api[-_]?key|credential`)
+
+// secretArgument returns the first option name or NAME=value argument of the
+// unit commands that looks like it carries a secret, without its value.
+func (s *systemd) secretArgument() string {
+	args := append([]string{}, s.Arguments...)
+	args = append(args, s.Option.strings(optionExecStartPost, nil)...)
+	args = append(args, s.Option.strings(optionOnFailureCommand, nil)...)
+	for _, arg := range args {
+		name := arg
+		if i := strings.IndexByte(arg, '='); i >= 0 {
+			name = arg[:i]
+		} else if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if secretNameRe.MatchString(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// unitFilePerm is how unit files are written.
+type unitFilePerm struct {
+	mode     os.FileMode
+	setMode  bool
+	uid, gid int // -1 leaves the owner or group as is.
+}
+
+func (p unitFilePerm) apply(f *os.File) error {
+	if p.setMode {
+		if err := f.Chmod(p.mode); err != nil {
+			return err
+		}
+	}
+	if p.uid != -1 || p.gid != -1 {
+		return f.Chown(p.uid, p.gid)
+	}
+	return nil
+}
+
+// unitFilePerm reads the UnitFileMode, UnitFileOwner and UnitFileGroup
+// options, looking up the accounts. Without UnitFileMode, a system unit
+// that carries a secret gets secretUnitFileMode and secretUnitFileGroup;
+// a user unit keeps the default and only a warning is reported.
+func (s *systemd) unitFilePerm() (unitFilePerm, error) {
+	p := unitFilePerm{uid: -1, gid: -1}
+	var err error
+	p.mode, p.setMode, err = s.unitFileMode()
+	if err != nil {
+		return p, err
+	}
+	if secret := s.secretArgument(); len(secret) != 0 && !p.setMode {
+		if s.userService() {
+			s.warn("%s.service passes %s on its command line but is readable by everyone; set %s.", s.Name, secret, optionUnitFileMode)
+		} else {
+			p.mode, p.setMode = secretUnitFileMode, true
+			if g, err := user.LookupGroup(secretUnitFileGroup); err == nil && len(s.Option.string(optionUnitFileGroup, "")) == 0 {
+				p.gid, _ = strconv.Atoi(g.Gid)
+			}
+			s.warn("%s.service passes %s on its command line; writing it with mode %#o.", s.Name, secret, p.mode)
+		}
+	}
+	if name := s.Option.string(optionUnitFileOwner, ""); len(name) != 0 {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return p, fmt.Errorf("%s: %v", optionUnitFileOwner, err)
+		}
+		p.uid, _ = strconv.Atoi(u.Uid)
+	}
+	if name := s.Option.string(optionUnitFileGroup, ""); len(name) != 0 {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return p, fmt.Errorf("%s: %v", optionUnitFileGroup, err)
+		}
+		p.gid, _ = strconv.Atoi(g.Gid)
+	}
+	return p, nil
+}
+
+// installedPath reads the executable from ConditionFileIsExecutable of the
+// installed unit. Units written by older versions escape spaces as \x20.
+func (s *systemd) installedPath() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	path, err := readPrefixedLine(cp, "ConditionFileIsExecutable=")
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(path, `\x20`, " ", -1), nil
+}
+
+// appArmorDir is where AppArmorProfilePath is copied to.
+var appArmorDir = "/etc/apparmor.d/"
+
+func (s *systemd) appArmorProfileDest() string {
+	src := s.Option.string(optionAppArmorProfilePath, "")
+	if len(src) == 0 || s.userService() {
+		return ""
+	}
+	return appArmorDir + filepath.Base(src)
+}
+
+// installAppArmorProfile copies the AppArmorProfilePath file into
+// /etc/apparmor.d and loads it. It does nothing without AppArmor.
+func (s *systemd) installAppArmorProfile() error {
+	dest := s.appArmorProfileDest()
+	if len(dest) == 0 || !appArmorEnabled() {
+		return nil
+	}
+	s.progress("loading apparmor profile")
+	b, err := ioutil.ReadFile(s.Option.string(optionAppArmorProfilePath, ""))
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(dest, b, 0644); err != nil {
+		return err
+	}
+	return run("apparmor_parser", "-r", dest)
+}
+
+// removeAppArmorProfile unloads and removes the profile installed by
+// installAppArmorProfile.
+func (s *systemd) removeAppArmorProfile() error {
+	dest := s.appArmorProfileDest()
+	if len(dest) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(dest); err != nil {
+		return nil
+	}
+	if appArmorEnabled() {
+		if err := run("apparmor_parser", "-R", dest); err != nil {
+			return err
+		}
+	}
+	return os.Remove(dest)
+}
+
+func (s *systemd) Install() error {
+	confPath, err := s.configPath()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(confPath)
+	if err == nil {
+		return fmt.Errorf("Init already exists: %s", confPath)
+	}
+
+	perm, err := s.unitFilePerm()
+	if err != nil {
+		return err
+	}
+	path, err := s.execPath()
+	if err != nil {
+		return err
+	}
+	to, err := s.templateData(path)
+	if err != nil {
+		return err
+	}
+	if err = checkRestartBackoff(to); err != nil {
+		return err
+	}
+	if to.PrivateNetwork && !to.WithSocket {
+		msg := fmt.Sprintf("%s.service has PrivateNetwork without WithSocket; it can only reach loopback.", s.Name)
+		s.warn("%s", msg)
+		if l, lerr := s.SystemLogger(nil); lerr == nil {
+			l.Warning(msg)
+		}
+	}
+
+	if s.userService() {
+		// Ensure that ~/.config/systemd/user exists.
+		if err = os.MkdirAll(filepath.Dir(confPath), 0755); err != nil {
+			return err
+		}
+	}
+
+	s.progress("writing unit file")
+	f, err := os.Create(confPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = perm.apply(f); err != nil {
+		return err
+	}
+
+	err = s.template(systemdScript).Execute(f, to)
+	if err != nil {
+		return err
+	}
+
+	mask := s.Option.bool(optionMaskOnInstall, optionMaskOnInstallDefault)
+	if !mask {
+		s.progress("enabling")
+		err = s.systemctl("enable", s.Name+".service")
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Config.WithSocket {
+		s.progress("writing socket file")
+		socketFilePath, err := s.socketPath()
+		if err != nil {
+			return err
+		}
+		_, err = os.Stat(socketFilePath)
+		if err == nil {
+			return fmt.Errorf("Socket already exists: %s", socketFilePath)
+		}
+		if err = s.writeSocket(socketFilePath, to, perm); err != nil {
+			return err
+		}
+	}
+
+	if len(to.OnFailureCommand) != 0 {
+		s.progress("writing failure handler")
+		notifyPath, err := s.failureNotifyPath()
+		if err != nil {
+			return err
+		}
+		if err = s.writeUnit(notifyPath, systemdFailureNotify, to, perm); err != nil {
+			return err
+		}
+	}
+
+	if s.alsoSysV() {
+		s.progress("writing sysv wrapper")
+		if err = s.installSysVWrapper(to); err != nil {
+			return err
+		}
+	}
+
+	if err = s.installAppArmorProfile(); err != nil {
+		return err
+	}
+
+	if s.Option.bool(optionEnableLinger, optionEnableLingerDefault) {
+		s.progress("enabling linger")
+		if err = s.linger("enable-linger"); err != nil {
+			return err
+		}
+	}
+
+	s.progress("reloading daemon")
+	if err = s.daemonReload(); err != nil || !mask {
+		return err
+	}
+	// The unit file occupies the path of a lasting mask, so systemctl mask
+	// without --runtime fails.
+	s.progress("masking")
+	return s.systemctl("mask", "--runtime", s.Name+".service")
+}
+
+// bundle renders the files Install writes and lists the commands it runs,
+// with daemon-reload before enable, as the files are not in place yet.
+// User services and EnableLinger depend on the user installing them, which
+// is not known until the bundle is applied, so they are refused.
+func (s *systemd) bundle() ([]bundleFile, [][]string, error) {
+	if s.userService() {
+		return nil, nil, fmt.Errorf("Bundle does not support %s.", optionUserService)
+	}
+	if s.Option.bool(optionEnableLinger, optionEnableLingerDefault) {
+		return nil, nil, fmt.Errorf("Bundle does not support %s.", optionEnableLinger)
+	}
+	confPath, err := s.configPath()
+	if err != nil {
+		return nil, nil, err
+	}
+	path := s.executable()
+	if !filepath.IsAbs(path) {
+		if path, err = s.execPath(); err != nil {
+			return nil, nil, err
+		}
+	}
+	to, err := s.templateData(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	mode, setMode, err := s.unitFileMode()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !setMode {
+		mode = 0644
+	}
+	owner, group := s.Option.string(optionUnitFileOwner, ""), s.Option.string(optionUnitFileGroup, "")
+	if secret := s.secretArgument(); len(secret) != 0 && !setMode {
+		mode = secretUnitFileMode
+		if len(group) == 0 {
+			group = secretUnitFileGroup
+		}
+	}
+
+	var files []bundleFile
+	render := func(path, template string, mode os.FileMode, owner, group string) error {
+		var buf bytes.Buffer
+		if err := s.template(template).Execute(&buf, to); err != nil {
+			return err
+		}
+		files = append(files, bundleFile{path, mode, owner, group, buf.Bytes()})
+		return nil
+	}
+	if err = render(confPath, systemdScript, mode, owner, group); err != nil {
+		return nil, nil, err
+	}
+	if s.Config.WithSocket {
+		socketFilePath, err := s.socketPath()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = render(socketFilePath, systemdSocket, mode, owner, group); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(to.OnFailureCommand) != 0 {
+		notifyPath, err := s.failureNotifyPath()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = render(notifyPath, systemdFailureNotify, mode, owner, group); err != nil {
+			return nil, nil, err
+		}
+	}
+	if s.alsoSysV() {
+		if err = render(s.sysvWrapperPath(), systemdSysVWrapper, 0755, "", ""); err != nil {
+			return nil, nil, err
+		}
+	}
+	var commands [][]string
+	if dest := s.appArmorProfileDest(); len(dest) != 0 {
+		b, err := ioutil.ReadFile(s.Option.string(optionAppArmorProfilePath, ""))
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, bundleFile{path: dest, mode: 0644, data: b})
+		commands = append(commands, []string{"apparmor_parser", "-r", dest})
+	}
+
+	commands = append(commands, []string{"systemctl", "daemon-reload"})
+	if s.Option.bool(optionMaskOnInstall, optionMaskOnInstallDefault) {
+		commands = append(commands, []string{"systemctl", "mask", "--runtime", s.Name + ".service"})
+	} else {
+		commands = append(commands, []string{"systemctl", "enable", s.Name + ".service"})
+	}
+	return files, commands, nil
+}
+
+// linger runs loginctl enable-linger or disable-linger for the current user.
+func (s *systemd) linger(verb string) error {
+	u, err := user.Current()
+	if err != nil {
+		return err
+	}
+	return run("loginctl", verb, u.Username)
+}
+
+// unitFileState returns the UnitFileState property, such as "enabled" or
+// "masked-runtime".
+func (s *systemd) unitFileState() (string, error) {
+	blocks, err := systemctlShow(s.userService(), []string{"UnitFileState"}, s.Name+".service")
+	if err != nil {
+		return "", err
+	}
+	return blocks[0]["UnitFileState"], nil
+}
+
+// unmaskUnit removes a mask of the unit, reporting whether there was one.
+func (s *systemd) unmaskUnit() (bool, error) {
+	state, err := s.unitFileState()
+	if err != nil {
+		return false, err
 	}
-	return s.Name
+	switch state {
+	case "masked":
+		return true, s.systemctl("unmask", s.Name+".service")
+	case "masked-runtime":
+		return true, s.systemctl("unmask", "--runtime", s.Name+".service")
+	}
+	return false, nil
 }
 
-// Systemd services should be supported, but are not currently.
-var errNoUserServiceSystemd = errors.New("User services are not supported on systemd.")
+func (s *systemd) unmask() error {
+	if _, err := s.unmaskUnit(); err != nil {
+		return err
+	}
+	return s.systemctl("enable", s.Name+".service")
+}
 
-func (s *systemd) configPath() (cp string, err error) {
-	if s.Option.bool(optionUserService, optionUserServiceDefault) {
-		err = errNoUserServiceSystemd
-		return
+// daemonReload runs systemctl daemon-reload, only logging a failure if the
+// LenientDaemonReload option is set.
+func (s *systemd) daemonReload() error {
+	err := s.systemctl("daemon-reload")
+	if err == nil || !s.Option.bool(optionLenientDaemonReload, optionLenientDaemonReloadDefault) {
+		return err
+	}
+	if l, lerr := s.SystemLogger(nil); lerr == nil {
+		l.Warningf("Unit %s.service installed, but daemon-reload failed: %v", s.Name, err)
 	}
-	cp = "/etc/systemd/system/" + s.Config.Name + ".service"
-	return
+	return nil
 }
 
-func (s *systemd) socketPath() (sp string) {
-	return "/etc/systemd/system/" + s.Config.Name + ".socket"
+func (s *systemd) writeSocket(path string, to *systemdTemplateData, perm unitFilePerm) error {
+	return s.writeUnit(path, systemdSocket, to, perm)
 }
 
-func (s *systemd) template(systemdType string) *template.Template {
-	return template.Must(template.New("").Funcs(tf).Parse(systemdType))
+// writeUnit renders the unit template to path.
+func (s *systemd) writeUnit(path, template string, to *systemdTemplateData, perm unitFilePerm) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = perm.apply(f); err != nil {
+		return err
+	}
+	return s.template(template).Execute(f, to)
 }
 
-func (s *systemd) Install() error {
+// repair installs again if the unit file is missing, removing a socket
+// file or SysV wrapper left behind. Otherwise it writes a missing socket
+// file or SysV wrapper, enables the unit if needed and reloads the daemon.
+func (s *systemd) repair() error {
 	confPath, err := s.configPath()
 	if err != nil {
 		return err
 	}
-	_, err = os.Stat(confPath)
-	if err == nil {
-		return fmt.Errorf("Init already exists: %s", confPath)
+	socketFilePath, err := s.socketPath()
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(confPath); os.IsNotExist(err) {
+		s.progress("repair: unit file missing, installing again")
+		notifyPath, err := s.failureNotifyPath()
+		if err != nil {
+			return err
+		}
+		orphans := []string{socketFilePath, notifyPath}
+		if s.alsoSysV() {
+			orphans = append(orphans, s.sysvWrapperPath())
+		}
+		for _, orphan := range orphans {
+			err = os.Remove(orphan)
+			if err == nil {
+				s.progress("repair: removed " + orphan)
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return s.Install()
 	}
 
-	f, err := os.Create(confPath)
+	perm, err := s.unitFilePerm()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
 	path, err := s.execPath()
 	if err != nil {
 		return err
 	}
-
-	var to = &struct {
-		*Config
-		Path         string
-		ReloadSignal string
-		PIDFile      string
-	}{
-		s.Config,
-		path,
-		s.Option.string(optionReloadSignal, ""),
-		s.Option.string(optionPIDFile, ""),
+	to, err := s.templateData(path)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(socketFilePath); s.Config.WithSocket && os.IsNotExist(err) {
+		s.progress("repair: writing missing socket file")
+		if err = s.writeSocket(socketFilePath, to, perm); err != nil {
+			return err
+		}
+	}
+	if _, err = os.Stat(s.sysvWrapperPath()); s.alsoSysV() && os.IsNotExist(err) {
+		s.progress("repair: writing missing sysv wrapper")
+		if err = s.installSysVWrapper(to); err != nil {
+			return err
+		}
+	}
+	if s.systemctl("is-enabled", "--quiet", s.Name+".service") != nil {
+		s.progress("repair: enabling")
+		if err = s.systemctl("enable", s.Name+".service"); err != nil {
+			return err
+		}
 	}
+	s.progress("reloading daemon")
+	return s.daemonReload()
+}
 
-	err = s.template(systemdScript).Execute(f, to)
+// verifyTimeout is how long installVerified waits for the service to run
+// unless the Timeout option is set.
+const verifyTimeout = 10 * time.Second
+
+func (s *systemd) installVerified(backupPath string) error {
+	confPath, err := s.configPath()
 	if err != nil {
 		return err
 	}
-
-	err = run("systemctl", "enable", s.Name+".service")
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(confPath); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	old, err := ioutil.ReadFile(confPath)
+	hadUnit := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if hadUnit {
+		s.progress("backing up unit file")
+		if err = ioutil.WriteFile(backupPath, old, 0600); err != nil {
+			return err
+		}
+		if err = os.Remove(confPath); err != nil {
+			return err
+		}
+	}
+	// The socket file, failure handler and SysV wrapper are written again
+	// from the current configuration and are not restored.
+	notifyPath, err := s.failureNotifyPath()
 	if err != nil {
 		return err
 	}
-
+	generated := []string{notifyPath}
 	if s.Config.WithSocket {
-		socketFilePath := s.socketPath()
-		_, err = os.Stat(socketFilePath)
-		if err == nil {
-			return fmt.Errorf("Socket already exists: %s", socketFilePath)
-		}
-		fSocket, err := os.Create(socketFilePath)
+		socketFilePath, err := s.socketPath()
 		if err != nil {
 			return err
 		}
-		defer fSocket.Close()
+		generated = append(generated, socketFilePath)
+	}
+	if s.alsoSysV() {
+		generated = append(generated, s.sysvWrapperPath())
+	}
+	for _, p := range generated {
+		if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err = s.Install(); err != nil {
+		if !hadUnit {
+			return err
+		}
+		if rerr := ioutil.WriteFile(confPath, old, mode); rerr != nil {
+			return fmt.Errorf("%v; restore failed: %v", err, rerr)
+		}
+		if rerr := s.systemctl("daemon-reload"); rerr != nil {
+			return fmt.Errorf("%v; restore failed: %v", err, rerr)
+		}
+		return err
+	}
+
+	s.progress("restarting")
+	err = s.Restart()
+	if err == nil {
+		err = s.waitRunning(s.Option.duration(optionTimeout, verifyTimeout))
+	}
+	if err == nil {
+		return nil
+	}
+	if !hadUnit {
+		return fmt.Errorf("New unit failed: %v", err)
+	}
+
+	s.progress("restoring unit file")
+	if rerr := ioutil.WriteFile(confPath, old, mode); rerr != nil {
+		return fmt.Errorf("New unit failed: %v; restore failed: %v", err, rerr)
+	}
+	if rerr := s.systemctl("daemon-reload"); rerr != nil {
+		return fmt.Errorf("New unit failed: %v; restore failed: %v", err, rerr)
+	}
+	if rerr := s.Restart(); rerr != nil {
+		return fmt.Errorf("New unit failed: %v; restored unit failed to start: %v", err, rerr)
+	}
+	return fmt.Errorf("New unit failed, restored %s: %v", backupPath, err)
+}
 
-		err = s.template(systemdSocket).Execute(fSocket, to)
+// waitRunning polls the unit until it is active or timeout passes.
+func (s *systemd) waitRunning(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		blocks, err := systemctlShow(s.userService(), []string{"ActiveState"}, s.Name+".service")
 		if err != nil {
 			return err
 		}
+		state := blocks[0]["ActiveState"]
+		if systemdStatus(state) == StatusRunning {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s.service is %s after %v", s.Name, state, timeout)
+		}
+		time.Sleep(250 * time.Millisecond)
 	}
-
-	return run("systemctl", "daemon-reload")
 }
 
 func (s *systemd) Uninstall() error {
-	sp := s.socketPath()
-	_, err := os.Stat(sp)
+	if s.Option.bool(optionStopOnUninstall, optionStopOnUninstallDefault) {
+		// systemctl stop waits for the unit to stop.
+		blocks, err := systemctlShow(s.userService(), []string{"ActiveState"}, s.Name+".service")
+		if err == nil && systemdStatus(blocks[0]["ActiveState"]) == StatusRunning {
+			s.progress("stopping")
+			if err = s.Stop(); err != nil {
+				return err
+			}
+		}
+	}
+
+	sp, err := s.socketPath()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(sp)
 	if err == nil {
-		err = run("systemctl", "disable", s.Name+".socket")
+		err = s.systemctl("disable", s.Name+".socket")
 		if err != nil {
 			return err
 		}
@@ -138,10 +1545,18 @@ func (s *systemd) Uninstall() error {
 		}
 	}
 
-	err = run("systemctl", "disable", s.Name+".service")
+	// MaskOnInstall does not enable the unit, so a masked one has nothing
+	// to disable.
+	masked, err := s.unmaskUnit()
 	if err != nil {
 		return err
 	}
+	if !masked {
+		err = s.systemctl("disable", s.Name+".service")
+		if err != nil {
+			return err
+		}
+	}
 	cp, err := s.configPath()
 	if err != nil {
 		return err
@@ -150,6 +1565,37 @@ func (s *systemd) Uninstall() error {
 		return err
 	}
 
+	notifyPath, err := s.failureNotifyPath()
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(notifyPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if s.alsoSysV() {
+		err = os.Remove(s.sysvWrapperPath())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err = s.removeAppArmorProfile(); err != nil {
+		return err
+	}
+
+	if s.Option.bool(optionPurgeData, optionPurgeDataDefault) {
+		if err = s.purgeData(); err != nil {
+			return err
+		}
+	}
+
+	if s.userService() && s.Option.bool(optionDisableLingerOnUninstall, optionDisableLingerOnUninstallDefault) {
+		if err = s.linger("disable-linger"); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -160,60 +1606,514 @@ func (s *systemd) Logger(errs chan<- error) (Logger, error) {
 	return s.SystemLogger(errs)
 }
 func (s *systemd) SystemLogger(errs chan<- error) (Logger, error) {
-	return newSysLogger(s.Name, errs)
+	return newSysLogger(s.Name, s.Option, errs)
 }
 
 func (s *systemd) Run() (err error) {
+	var sig os.Signal
+	defer func() { err = reraise(s.Config, sig, err) }()
+	defer redirectOutput(s, s.Config)()
+	states := s.states()
+	defer states.set(StateStopped)
+
+	states.set(StateStarting)
 	err = s.i.Start(s)
 	if err != nil {
 		return err
 	}
+	states.set(StateRunning)
+	sdNotify(sdNotifyReady)
+
+	stopWatchdog := make(chan struct{})
+	if interval := watchdogInterval(); interval > 0 {
+		go watchdog(interval, stopWatchdog)
+	}
 
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
+	sig = runWait(s, s.Config, s.i, syscall.SIGTERM, os.Interrupt)
+	states.set(StateStopping)
 
+	close(stopWatchdog)
+	sdNotify(sdNotifyStopping)
+	drain(s, s.i, s.timeout(optionStopTimeout, systemdDefaultStopTimeout))
 	return s.i.Stop(s)
 }
 
 func (s *systemd) Start() error {
-	return run("systemctl", "start", s.Name+".service")
+	if s.stopSocketToo() {
+		if err := s.systemctl("start", s.Name+".socket"); err != nil {
+			return err
+		}
+	}
+	return s.systemctl("start", s.Name+".service")
 }
 
 func (s *systemd) Stop() error {
-	return run("systemctl", "stop", s.Name+".service")
+	if s.stopSocketToo() {
+		// Stop the socket first so a connection does not start the service again.
+		if err := s.systemctl("stop", s.Name+".socket"); err != nil {
+			return err
+		}
+	}
+	return s.systemctl("stop", s.Name+".service")
+}
+
+// stopSocketToo reports whether Start and Stop act on the socket unit too.
+func (s *systemd) stopSocketToo() bool {
+	return s.Config.WithSocket && s.Option.bool(optionStopSocketToo, optionStopSocketTooDefault)
 }
 
 func (s *systemd) Restart() error {
-	return run("systemctl", "restart", s.Name+".service")
+	return s.systemctl("restart", s.Name+".service")
+}
+
+// listeningPorts returns the sockets of the socket unit and those the
+// main process listens on.
+func (s *systemd) listeningPorts() ([]string, error) {
+	units := []string{s.Name + ".service"}
+	if s.Config.WithSocket {
+		units = append(units, s.Name+".socket")
+	}
+	blocks, err := systemctlShow(s.userService(), []string{"MainPID", "Listen"}, units...)
+	if err != nil {
+		return nil, err
+	}
+	var ports []string
+	if len(blocks) > 1 {
+		if p, ok := systemdListen(blocks[1]["Listen"]); ok {
+			ports = append(ports, p)
+		}
+	}
+	if pid, _ := strconv.Atoi(blocks[0]["MainPID"]); pid > 0 {
+		running, err := procListening(pid)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range running {
+			if len(ports) == 0 || p != ports[0] {
+				ports = append(ports, p)
+			}
+		}
+	}
+	return ports, nil
+}
+
+// launchedByManager checks INVOCATION_ID, which systemd sets for every unit
+// it starts, and that this process runs in the cgroup of the unit.
+func (s *systemd) launchedByManager() bool {
+	if len(os.Getenv("INVOCATION_ID")) == 0 {
+		return false
+	}
+	b, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return false
+	}
+	unit := "/" + s.Name + ".service"
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasSuffix(line, unit) {
+			return true
+		}
+	}
+	return false
+}
+
+// cgroup reads the ControlGroup property of the unit.
+func (s *systemd) cgroup() (string, error) {
+	blocks, err := systemctlShow(s.userService(), []string{"ControlGroup"}, s.Name+".service")
+	if err != nil {
+		return "", err
+	}
+	return blocks[0]["ControlGroup"], nil
+}
+
+// resourceUsage reads the MemoryCurrent and CPUUsageNSec properties, which
+// systemd leaves unset while accounting is off.
+func (s *systemd) resourceUsage() (ResourceUsage, error) {
+	var u ResourceUsage
+	unit := s.Name + ".service"
+	blocks, err := systemctlShow(s.userService(), []string{"ActiveState", "MemoryCurrent", "CPUUsageNSec"}, unit)
+	if err != nil {
+		return u, err
+	}
+	props := blocks[0]
+	if systemdStatus(props["ActiveState"]) != StatusRunning {
+		return u, fmt.Errorf("%s is not running.", unit)
+	}
+	var values [2]uint64
+	for i, p := range []struct{ name, option string }{
+		{"MemoryCurrent", optionMemoryAccounting},
+		{"CPUUsageNSec", optionCPUAccounting},
+	} {
+		// Older versions print the maximum uint64 instead of [not set].
+		v, err := strconv.ParseUint(props[p.name], 10, 64)
+		if err != nil || v == math.MaxUint64 {
+			if !s.Option.bool(p.option, true) {
+				return u, fmt.Errorf("%s is not known for %s, as the %s option is false.", p.name, unit, p.option)
+			}
+			return u, fmt.Errorf("%s is not known for %s; set the MemoryAccounting and CPUAccounting options to true or enable them system-wide.", p.name, unit)
+		}
+		values[i] = v
+	}
+	u.Memory, u.CPU = values[0], time.Duration(values[1])
+	return u, nil
+}
+
+// transitioning checks for a pending ActiveState, or the auto-restart
+// SubState of a unit waiting out RestartSec, which older versions report
+// as activating and newer ones as failed or inactive.
+func (s *systemd) transitioning() (bool, error) {
+	blocks, err := systemctlShow(s.userService(), []string{"ActiveState", "SubState"}, s.Name+".service")
+	if err != nil {
+		return false, err
+	}
+	switch blocks[0]["ActiveState"] {
+	case "activating", "deactivating", "reloading", "refreshing":
+		return true, nil
+	}
+	return blocks[0]["SubState"] == "auto-restart", nil
+}
+
+// systemdTimestampLayout is how systemctl show prints timestamps, in the
+// local time zone.
+const systemdTimestampLayout = "Mon 2006-01-02 15:04:05 MST"
+
+// startedAt prefers the start of the main process, which is reset when
+// systemd restarts it, and otherwise uses when the unit became active, as
+// for a oneshot unit with RemainAfterExit.
+func (s *systemd) startedAt() (time.Time, error) {
+	unit := s.Name + ".service"
+	blocks, err := systemctlShow(s.userService(), []string{"ActiveState", "ExecMainStartTimestamp", "ActiveEnterTimestamp"}, unit)
+	if err != nil {
+		return time.Time{}, err
+	}
+	props := blocks[0]
+	if systemdStatus(props["ActiveState"]) != StatusRunning {
+		return time.Time{}, fmt.Errorf("%s is not running.", unit)
+	}
+	for _, name := range []string{"ExecMainStartTimestamp", "ActiveEnterTimestamp"} {
+		if v := props[name]; len(v) != 0 && v != "n/a" {
+			return time.ParseInLocation(systemdTimestampLayout, v, time.Local)
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s has no start timestamp.", unit)
+}
+
+// systemdListen converts a Listen property such as "[::]:8080 (Stream)"
+// to a ListeningPorts entry.
+func systemdListen(listen string) (string, bool) {
+	i := strings.LastIndex(listen, " (")
+	if i < 0 {
+		return "", false
+	}
+	addr, kind := listen[:i], strings.TrimSuffix(listen[i+2:], ")")
+	proto := map[string]string{"Stream": "tcp", "Datagram": "udp"}[kind]
+	switch {
+	case len(proto) == 0:
+		return "", false
+	case strings.HasPrefix(addr, "/"):
+		return "unix:" + addr, true
+	}
+	return proto + ":" + addr, true
+}
+
+// journalFieldRe matches journal field names, see systemd.journal-fields(7).
+var journalFieldRe = regexp.MustCompile(`^[A-Z0-9_]+$`)
+
+// journalctlArgs returns the journalctl arguments selecting the entries
+// of the service that match filter.
+func (s *systemd) journalctlArgs(filter map[string]string, extra ...string) ([]string, error) {
+	unit := "--unit=" + s.Name + ".service"
+	if s.userService() {
+		unit = "--user-unit=" + s.Name + ".service"
+	}
+	args := append([]string{unit, "--output=json", "--no-pager"}, extra...)
+	fields := make([]string, 0, len(filter))
+	for field := range filter {
+		if !journalFieldRe.MatchString(field) {
+			return nil, fmt.Errorf("Invalid journal field %q.", field)
+		}
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		args = append(args, field+"="+filter[field])
+	}
+	return args, nil
+}
+
+func (s *systemd) journalEntries(ctx context.Context, filter map[string]string) ([]JournalEntry, error) {
+	args, err := s.journalctlArgs(filter)
+	if err != nil {
+		return nil, err
+	}
+	out, err := runCommandContext(ctx, "journalctl", args...)
+	if err != nil {
+		return nil, err
+	}
+	var entries []JournalEntry
+	sc := bufio.NewScanner(strings.NewReader(out))
+	sc.Buffer(nil, journalMaxLine)
+	for sc.Scan() {
+		e, err := parseJournalEntry(sc.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+// followJournal streams journalctl directly rather than through the
+// CommandRunner, which only returns output once the command exits.
+func (s *systemd) followJournal(ctx context.Context, filter map[string]string) (<-chan JournalEntry, <-chan error, error) {
+	args, err := s.journalctlArgs(filter, "--follow", "--lines=0")
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := exec.CommandContext(ctx, "journalctl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	entries := make(chan JournalEntry)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(entries)
+		err := readJournal(ctx, stdout, entries)
+		if werr := cmd.Wait(); err == nil && ctx.Err() == nil {
+			err = werr
+		}
+		if err != nil {
+			errs <- err
+		}
+	}()
+	return entries, errs, nil
+}
+
+// journalMaxLine bounds a single JSON entry; the journal allows large
+// binary fields, so the bufio default of 64 KiB is too small.
+const journalMaxLine = 4 << 20
+
+// readJournal sends the entries read from r until it ends or ctx is done.
+func readJournal(ctx context.Context, r io.Reader, entries chan<- JournalEntry) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, journalMaxLine)
+	for sc.Scan() {
+		e, err := parseJournalEntry(sc.Bytes())
+		if err != nil {
+			return err
+		}
+		select {
+		case entries <- e:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return sc.Err()
+}
+
+// parseJournalEntry parses a line of journalctl --output=json. Fields are
+// strings, arrays of bytes for binary values, or arrays of either when a
+// field occurs more than once, in which case the first value is kept.
+func parseJournalEntry(line []byte) (JournalEntry, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return JournalEntry{}, fmt.Errorf("Invalid journal entry: %v.", err)
+	}
+	e := JournalEntry{Fields: make(map[string]string, len(raw))}
+	for field, value := range raw {
+		if v, ok := journalValue(value); ok {
+			e.Fields[field] = v
+		}
+	}
+	e.Message = e.Fields["MESSAGE"]
+	if p, err := strconv.Atoi(e.Fields["PRIORITY"]); err == nil {
+		e.Priority = p
+	}
+	if us, err := strconv.ParseInt(e.Fields["__REALTIME_TIMESTAMP"], 10, 64); err == nil {
+		e.Time = time.Unix(0, us*int64(time.Microsecond))
+	}
+	return e, nil
+}
+
+func journalValue(value json.RawMessage) (string, bool) {
+	var str string
+	if json.Unmarshal(value, &str) == nil {
+		return str, true
+	}
+	var nums []int
+	if json.Unmarshal(value, &nums) == nil {
+		bin := make([]byte, 0, len(nums))
+		for _, n := range nums {
+			bin = append(bin, byte(n))
+		}
+		return string(bin), true
+	}
+	var values []json.RawMessage
+	if json.Unmarshal(value, &values) == nil && len(values) > 0 {
+		return journalValue(values[0])
+	}
+	return "", false
+}
+
+// systemctlVerbs lists the systemctl verbs Exec runs. They all act on the
+// units named after them, so the ones that act on the whole system, such as
+// poweroff or isolate, can never be reached through Exec.
+var systemctlVerbs = map[string]bool{
+	"start":                 true,
+	"stop":                  true,
+	"reload":                true,
+	"restart":               true,
+	"try-restart":           true,
+	"reload-or-restart":     true,
+	"try-reload-or-restart": true,
+	"kill":                  true,
+	"clean":                 true,
+	"freeze":                true,
+	"thaw":                  true,
+	"is-active":             true,
+	"is-failed":             true,
+	"status":                true,
+	"show":                  true,
+	"cat":                   true,
+	"list-dependencies":     true,
+	"set-property":          true,
+	"reset-failed":          true,
+	"is-enabled":            true,
+	"enable":                true,
+	"disable":               true,
+	"reenable":              true,
+	"preset":                true,
+	"mask":                  true,
+	"unmask":                true,
+	"revert":                true,
+}
+
+func (s *systemd) exec(args ...string) (string, error) {
+	if !systemctlVerbs[args[0]] {
+		return "", fmt.Errorf("Refusing to run %q, which is not a systemctl unit command.", args[0])
+	}
+	return runCombined("systemctl", s.systemctlArgs(append([]string{args[0], s.Name + ".service"}, args[1:]...)...)...)
+}
+
+// States understood by the systemd notification socket. See sd_notify(3).
+const (
+	sdNotifyReady    = "READY=1"
+	sdNotifyStopping = "STOPPING=1"
+	sdNotifyWatchdog = "WATCHDOG=1"
+	sdNotifyStatus   = "STATUS="
+)
+
+// sdNotify sends state to the socket named by $NOTIFY_SOCKET.
+// systemd only sets the variable for units that accept notifications,
+// so when it is empty nothing is sent and no error is returned.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if len(name) == 0 {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often the watchdog must be notified,
+// or zero if systemd did not request watchdog notifications for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	// Notify at half the interval so a single late tick does not trip the watchdog.
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchdog notifies the watchdog every interval until stop is closed.
+func watchdog(interval time.Duration, stop <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			sdNotify(sdNotifyWatchdog)
+		case <-stop:
+			return
+		}
+	}
 }
 
-const systemdScript = `[Unit]
+// Only command lines such as ExecStart understand escapes and quotes.
+// Path settings take the rest of the line verbatim, spaces included.
+const systemdScript = `{{range .DescriptionExtra}}# {{.}}
+{{end}}[Unit]
 Description={{.Description}}
-ConditionFileIsExecutable={{.Path|cmdEscape}}
+{{range .DescriptionExtra}}{{if isURI .Value}}Documentation={{.Value}}
+{{end}}{{end}}ConditionFileIsExecutable={{.Path}}
 {{if .WithSocket}}Requires={{.Name}}.socket{{end}}
+{{if .SessionBus}}PartOf=graphical-session.target
+After=graphical-session.target{{end}}
+{{if .ConditionArchitecture}}ConditionArchitecture={{.ConditionArchitecture}}{{end}}
+{{if .ConditionVirtualization}}ConditionVirtualization={{.ConditionVirtualization}}{{end}}
+{{if .StartLimitAction}}StartLimitAction={{.StartLimitAction}}{{end}}
+{{if .CollectMode}}CollectMode={{.CollectMode}}{{end}}
+{{if .OnFailure}}OnFailure={{range $i, $u := .OnFailure}}{{if $i}} {{end}}{{$u}}{{end}}{{end}}
+{{if .Conflicts}}Conflicts={{range $i, $u := .Conflicts}}{{if $i}} {{end}}{{$u}}{{end}}{{end}}
+{{if .RequiresMountsFor}}RequiresMountsFor={{range $i, $p := .RequiresMountsFor}}{{if $i}} {{end}}{{$p|cmd}}{{end}}{{end}}
 
 [Service]
 {{if .WithSocket}}NonBlocking=true{{end}}
+{{if .Type}}Type={{.Type}}{{end}}
+{{if .BusName}}BusName={{.BusName}}{{end}}
+{{if eq .Type "oneshot"}}RemainAfterExit={{if .RemainAfterExit}}yes{{else}}no{{end}}{{end}}
 
 StartLimitInterval=5
 StartLimitBurst=10
 LimitNOFILE={{.LimitNOFILE}}
-ExecStart={{.Path|cmdEscape}}{{range .Arguments}} {{.|cmd}}{{end}}
-{{if .ChRoot}}RootDirectory={{.ChRoot|cmd}}{{end}}
-{{if .WorkingDirectory}}WorkingDirectory={{.WorkingDirectory|cmdEscape}}{{end}}
-{{if .UserName}}User={{.UserName}}{{end}}
+{{range .FixupOwnership}}ExecStartPre=+/bin/chown -R {{printf "%s:" $.UserName|cmd}} {{.|cmd}}
+ExecStartPre=+/bin/chmod {{$.FixupMode}} {{.|cmd}}
+{{end}}ExecStart={{.Path|cmdEscape}}{{range .Arguments}} {{.|cmd}}{{end}}
+{{with .ExecStartPost}}ExecStartPost={{range $i, $a := .}}{{if $i}} {{$a|cmd}}{{else}}{{$a|cmdEscape}}{{end}}{{end}}{{end}}
+{{if .ChRoot}}RootDirectory={{.ChRoot}}{{end}}
+{{if .WorkingDirectory}}WorkingDirectory={{.WorkingDirectory}}{{end}}
+{{if and .UserName (not .UserService)}}User={{.UserName}}{{end}}
+{{if .SupplementaryGroups}}SupplementaryGroups={{range $i, $g := .SupplementaryGroups}}{{if $i}} {{end}}{{$g}}{{end}}{{end}}
+{{if .TimeoutSec}}TimeoutSec={{.TimeoutSec}}{{end}}
+{{if .TimeoutStopSec}}TimeoutStopSec={{.TimeoutStopSec}}{{end}}
 {{if .ReloadSignal}}ExecReload=/bin/kill -{{.ReloadSignal}} "$MAINPID"{{end}}
-{{if .PIDFile}}PIDFile={{.PIDFile|cmd}}{{end}}
+{{if .PIDFile}}PIDFile={{.PIDFile}}{{end}}
+{{if .NotifyAccess}}NotifyAccess={{.NotifyAccess}}{{end}}
+{{if .IOSchedulingClass}}IOSchedulingClass={{.IOSchedulingClass}}{{end}}
+{{if .IOSchedulingPriority}}IOSchedulingPriority={{.IOSchedulingPriority}}{{end}}
+{{if .IOWeight}}IOWeight={{.IOWeight}}{{end}}
+{{range .Accounting}}{{.Option}}={{.Value}}
+{{end}}{{if .AppArmorProfile}}AppArmorProfile={{.AppArmorProfile}}{{end}}
 UMask={{.UMask}}
-Restart=always
-RestartSec=120
+{{if .SessionBus}}Environment=DBUS_SESSION_BUS_ADDRESS=unix:path=%t/bus{{end}}
+{{if .ProtectProc}}ProtectProc={{.ProtectProc}}{{end}}
+{{if .ProcSubset}}ProcSubset={{.ProcSubset}}{{end}}
+{{if .PrivateNetwork}}PrivateNetwork=yes{{end}}
+{{range .Directories}}{{.Option}}={{range $i, $n := .Names}}{{if $i}} {{end}}{{$n}}{{end}}
+{{end}}{{if .Delegate}}Delegate={{.Delegate}}{{end}}
+{{if .PassEnvironment}}PassEnvironment={{range $i, $v := .PassEnvironment}}{{if $i}} {{end}}{{$v}}{{end}}{{end}}
+{{if .UnsetEnvironment}}UnsetEnvironment={{range $i, $v := .UnsetEnvironment}}{{if $i}} {{end}}{{$v}}{{end}}{{end}}
+{{if .Restart}}Restart={{.Restart}}{{if ne .Restart "no"}}
+RestartSec=120{{if .RestartMaxDelaySec}}
+RestartMaxDelaySec={{.RestartMaxDelaySec}}{{end}}{{if .RestartSteps}}
+RestartSteps={{.RestartSteps}}{{end}}{{end}}{{end}}
 EnvironmentFile=-/etc/sysconfig/{{.Name}}
 
 [Install]
-WantedBy=multi-user.target
+WantedBy={{if .SessionBus}}graphical-session.target{{else if .UserService}}default.target{{else}}multi-user.target{{end}}
 `
 
 const systemdSocket = `[Unit]
@@ -223,5 +2123,37 @@ Description={{.SocketDescription}}
 
 [Socket]
 ListenStream={{.SocketListenStream}}
+{{if .SocketFileDescriptorName}}FileDescriptorName={{.SocketFileDescriptorName}}{{end}}
 NoDelay=true
 `
+
+const systemdFailureNotify = `[Unit]
+Description=Failure handler for {{.Name}}.service
+
+[Service]
+Type=oneshot
+ExecStart={{range $i, $a := .OnFailureCommand}}{{if $i}} {{$a|cmd}}{{else}}{{$a|cmdEscape}}{{end}}{{end}}
+`
+
+const systemdSysVWrapper = `#!/bin/sh
+### BEGIN INIT INFO
+# Provides:          {{.Name}}
+# Required-Start:
+# Required-Stop:
+# Default-Start:     2 3 4 5
+# Default-Stop:      0 1 6
+# Short-Description: {{.DisplayName}}
+# Description:       {{.Description}}
+### END INIT INFO
+
+# Installed alongside {{.Name}}.service; systemd manages the service.
+case "$1" in
+    start|stop|restart|reload|status)
+        exec systemctl "$1" {{.Name|shellQuote}}.service
+    ;;
+    *)
+    echo "Usage: $0 {start|stop|restart|reload|status}"
+    exit 1
+    ;;
+esac
+`
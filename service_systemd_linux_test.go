@@ -0,0 +1,1564 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket listens on a unix datagram socket and points
+// NOTIFY_SOCKET at it for the duration of the test.
+func fakeNotifySocket(t *testing.T) (*net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "servicenotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	os.Setenv("NOTIFY_SOCKET", name)
+	return conn, func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read notify socket: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	conn, cleanup := fakeNotifySocket(t)
+	defer cleanup()
+
+	for _, state := range []string{sdNotifyReady, sdNotifyStatus + "Loading data", sdNotifyWatchdog} {
+		if err := sdNotify(state); err != nil {
+			t.Fatalf("sdNotify(%q) err: %v", state, err)
+		}
+		if got := readNotify(t, conn); got != state {
+			t.Errorf("sdNotify(%q) sent %q", state, got)
+		}
+	}
+}
+
+func TestSdNotifyNoSocket(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify(sdNotifyReady); err != nil {
+		t.Errorf("sdNotify without NOTIFY_SOCKET err: %v", err)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	conn, cleanup := fakeNotifySocket(t)
+	defer cleanup()
+
+	os.Setenv("WATCHDOG_USEC", "20000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	interval := watchdogInterval()
+	if interval != 10*time.Millisecond {
+		t.Fatalf("watchdogInterval() = %v, want 10ms", interval)
+	}
+
+	stop := make(chan struct{})
+	go watchdog(interval, stop)
+	defer close(stop)
+	if got := readNotify(t, conn); got != sdNotifyWatchdog {
+		t.Errorf("watchdog sent %q, want %q", got, sdNotifyWatchdog)
+	}
+
+	os.Setenv("WATCHDOG_PID", "1")
+	defer os.Unsetenv("WATCHDOG_PID")
+	if interval := watchdogInterval(); interval != 0 {
+		t.Errorf("watchdogInterval() for another PID = %v, want 0", interval)
+	}
+}
+
+func renderSystemd(t *testing.T, s *systemd, path string) string {
+	to, err := s.templateData(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.template(systemdScript).Execute(&buf, to); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestSystemdSpacedPath(t *testing.T) {
+	s := &systemd{Config: &Config{
+		Name:             "myd",
+		WorkingDirectory: "/var/lib/My App",
+		Arguments:        []string{"-config", "/etc/My App/myd.conf"},
+	}}
+	unit := renderSystemd(t, s, "/opt/My App/bin/myd")
+	for _, want := range []string{
+		"ConditionFileIsExecutable=/opt/My App/bin/myd\n",
+		`ExecStart=/opt/My\x20App/bin/myd "-config" "/etc/My App/myd.conf"` + "\n",
+		"WorkingDirectory=/var/lib/My App\n",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit missing %q:\n%s", want, unit)
+		}
+	}
+}
+
+func TestSystemdNotifyAccess(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd"}}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); strings.Contains(unit, "NotifyAccess=") {
+		t.Errorf("simple unit has NotifyAccess:\n%s", unit)
+	}
+	s.Option = KeyValue{optionSystemdType: "notify"}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "NotifyAccess=main\n") {
+		t.Errorf("notify unit missing NotifyAccess=main:\n%s", unit)
+	}
+	s.Option = KeyValue{optionNotifyAccess: "all"}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "NotifyAccess=all\n") {
+		t.Errorf("unit missing NotifyAccess=all:\n%s", unit)
+	}
+	s.Option = KeyValue{optionNotifyAccess: "children"}
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("NotifyAccess=children accepted")
+	}
+}
+
+func TestSystemdDescriptionExtra(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{
+		optionDescriptionExtra: map[string]string{
+			"Contact": "ops@example.com",
+			"Repo":    "https://example.com/myd",
+		},
+	}}}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	for _, want := range []string{
+		"# Contact: ops@example.com\n# Repo: https://example.com/myd\n[Unit]\n",
+		"Documentation=https://example.com/myd\n",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit missing %q:\n%s", want, unit)
+		}
+	}
+	if strings.Contains(unit, "Documentation=ops@example.com") {
+		t.Errorf("unit uses a non-URI as Documentation:\n%s", unit)
+	}
+}
+
+func TestSystemdOneshot(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd-setup", Option: KeyValue{optionSystemdType: "oneshot"}}}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	for _, want := range []string{"\nType=oneshot\n", "\nRemainAfterExit=yes\n"} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("oneshot unit missing %q:\n%s", want, unit)
+		}
+	}
+	if strings.Contains(unit, "Restart=") {
+		t.Errorf("oneshot unit must not restart:\n%s", unit)
+	}
+
+	s.Option[optionRemainAfterExit] = false
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "RemainAfterExit=no\n") {
+		t.Errorf("unit missing RemainAfterExit=no:\n%s", unit)
+	}
+}
+
+func TestSystemdIOScheduling(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd-backup", Option: KeyValue{
+		optionIOSchedulingClass:    "best-effort",
+		optionIOSchedulingPriority: 7,
+		optionIOWeight:             10,
+	}}}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	for _, want := range []string{"IOSchedulingClass=best-effort\n", "IOSchedulingPriority=7\n", "IOWeight=10\n"} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit missing %q:\n%s", want, unit)
+		}
+	}
+
+	for _, bad := range []KeyValue{
+		{optionIOSchedulingClass: "idle", optionIOSchedulingPriority: 1},
+		{optionIOSchedulingPriority: 8},
+		{optionIOWeight: 0},
+	} {
+		s.Option = bad
+		if _, err := s.templateData("/usr/bin/myd"); err == nil {
+			t.Errorf("options %v accepted", bad)
+		}
+	}
+}
+
+func TestSystemdRequiresMountsFor(t *testing.T) {
+	// systemd escapes "-" in mount unit names, /mnt/backup-disk is
+	// mnt-backup\x2ddisk.mount, so the path must be passed as is.
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{
+		optionRequiresMountsFor: []string{"/data", "/mnt/backup-disk"},
+	}}}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	if want := `RequiresMountsFor="/data" "/mnt/backup-disk"` + "\n"; !strings.Contains(unit, want) {
+		t.Errorf("unit missing %q:\n%s", want, unit)
+	}
+
+	s.Option[optionRequiresMountsFor] = []string{"data"}
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("relative mount path accepted")
+	}
+}
+
+func TestSystemdStopTimeout(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd"}}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); strings.Contains(unit, "TimeoutStopSec=") {
+		t.Errorf("default unit sets TimeoutStopSec:\n%s", unit)
+	}
+	s.Option = KeyValue{optionStopTimeout: 1500 * time.Millisecond}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "TimeoutStopSec=2\n") {
+		t.Errorf("unit missing TimeoutStopSec=2:\n%s", unit)
+	}
+
+	// TimeoutSec= sets both, so TimeoutStopSec= must follow it to win.
+	s.Option[optionTimeout] = 30 * time.Second
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "TimeoutSec=30\nTimeoutStopSec=2\n") {
+		t.Errorf("unit missing TimeoutSec=30 before TimeoutStopSec=2:\n%s", unit)
+	}
+}
+
+func TestSystemdConflicts(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{
+		optionConflicts: []string{"myd-legacy.service", "getty@tty1.service"},
+	}}}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	if want := "Conflicts=myd-legacy.service getty@tty1.service\n"; !strings.Contains(unit, want) {
+		t.Errorf("unit missing %q:\n%s", want, unit)
+	}
+
+	for _, bad := range []string{"myd-legacy", "my d.service", "myd.service\nUser=root"} {
+		s.Option[optionConflicts] = []string{bad}
+		if _, err := s.templateData("/usr/bin/myd"); err == nil {
+			t.Errorf("Conflicts %q accepted", bad)
+		}
+	}
+}
+
+func TestSystemdFixupOwnership(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", UserName: "myd", UMask: "027", Option: KeyValue{
+		optionFixupOwnership: []string{"/var/lib/myd", "/var/log/my d"},
+	}}}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	want := `ExecStartPre=+/bin/chown -R "myd:" "/var/lib/myd"
+ExecStartPre=+/bin/chmod 0750 "/var/lib/myd"
+ExecStartPre=+/bin/chown -R "myd:" "/var/log/my d"
+ExecStartPre=+/bin/chmod 0750 "/var/log/my d"
+ExecStart=`
+	if !strings.Contains(unit, want) {
+		t.Errorf("unit missing %q:\n%s", want, unit)
+	}
+
+	s.UserName = ""
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("FixupOwnership without UserName accepted")
+	}
+}
+
+func TestSystemdListen(t *testing.T) {
+	for listen, want := range map[string]string{
+		"[::]:8080 (Stream)":     "tcp:[::]:8080",
+		"0.0.0.0:53 (Datagram)":  "udp:0.0.0.0:53",
+		"/run/myd.sock (Stream)": "unix:/run/myd.sock",
+		"/run/myd.fifo (FIFO)":   "",
+	} {
+		if got, _ := systemdListen(listen); got != want {
+			t.Errorf("systemdListen(%q) = %q, want %q", listen, got, want)
+		}
+	}
+}
+
+func TestSystemdBusName(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{optionBusName: "com.example.Myd"}}}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	for _, want := range []string{"\nType=dbus\n", "\nBusName=com.example.Myd\n"} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit missing %q:\n%s", want, unit)
+		}
+	}
+
+	for _, bad := range []KeyValue{
+		{optionBusName: "myd"},
+		{optionBusName: "com.1example.Myd"},
+		{optionBusName: ":1.42"},
+		{optionBusName: "com.example.Myd", optionSystemdType: "notify"},
+	} {
+		s.Option = bad
+		if _, err := s.templateData("/usr/bin/myd"); err == nil {
+			t.Errorf("options %v accepted", bad)
+		}
+	}
+}
+
+// recordRunner is a CommandRunner that records commands instead of
+// running them. Each returns output.
+type recordRunner struct {
+	commands []string
+	output   string
+	err      error
+	failOn   string // If set, err is returned only for this command.
+}
+
+func (r *recordRunner) Run(ctx context.Context, name string, args ...string) (string, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	r.commands = append(r.commands, command)
+	if len(r.failOn) != 0 && command != r.failOn {
+		return r.output, nil
+	}
+	return r.output, r.err
+}
+
+func TestSystemdExec(t *testing.T) {
+	r := &recordRunner{output: "active\n"}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	s := &systemd{Config: &Config{Name: "myd"}}
+	if out, err := Exec(s, "is-active", "--quiet"); err != nil || out != "active\n" {
+		t.Errorf("Exec(is-active) = %q, %v", out, err)
+	}
+	for _, verb := range []string{"poweroff", "halt", "kexec", "default", "daemon-reexec", "set-default", "suspend-then-hibernate", "list-units", "bogus"} {
+		if _, err := Exec(s, verb); err == nil {
+			t.Errorf("Exec(%s) accepted", verb)
+		}
+	}
+	if want := "systemctl is-active myd.service --quiet"; strings.Join(r.commands, ",") != want {
+		t.Errorf("commands = %q, want %q", r.commands, want)
+	}
+}
+
+func TestSystemdCommands(t *testing.T) {
+	r := &recordRunner{}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	s := &systemd{Config: &Config{Name: "myd"}}
+	for _, f := range []func() error{s.Start, s.Stop, s.Restart} {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "systemctl start myd.service,systemctl stop myd.service,systemctl restart myd.service"
+	if got := strings.Join(r.commands, ","); got != want {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestSystemdEnvironment(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{
+		optionPassEnvironment:  []string{"HTTPS_PROXY", "NO_PROXY"},
+		optionUnsetEnvironment: []string{"LD_PRELOAD"},
+	}}}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	for _, want := range []string{"PassEnvironment=HTTPS_PROXY NO_PROXY\n", "UnsetEnvironment=LD_PRELOAD\n"} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit missing %q:\n%s", want, unit)
+		}
+	}
+
+	s.Option[optionPassEnvironment] = []string{"HTTPS_PROXY=http://proxy"}
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("assignment accepted as PassEnvironment name")
+	}
+}
+
+func TestSystemdStopSocketToo(t *testing.T) {
+	r := &recordRunner{}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	s := &systemd{Config: &Config{Name: "myd", WithSocket: true, Option: KeyValue{optionStopSocketToo: true}}}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	want := "systemctl start myd.socket,systemctl start myd.service,systemctl stop myd.socket,systemctl stop myd.service"
+	if got := strings.Join(r.commands, ","); got != want {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestSystemdUserSessionBus(t *testing.T) {
+	os.Setenv("XDG_CONFIG_HOME", "/home/me/.config")
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+
+	s := &systemd{Config: &Config{Name: "myd", UserName: "me", Option: KeyValue{
+		optionUserService: true,
+		optionSessionBus:  true,
+	}}}
+	if cp, err := s.configPath(); err != nil || cp != "/home/me/.config/systemd/user/myd.service" {
+		t.Errorf("configPath() = %q, %v", cp, err)
+	}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	for _, want := range []string{
+		"PartOf=graphical-session.target\nAfter=graphical-session.target\n",
+		"Environment=DBUS_SESSION_BUS_ADDRESS=unix:path=%t/bus\n",
+		"WantedBy=graphical-session.target\n",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit missing %q:\n%s", want, unit)
+		}
+	}
+	if strings.Contains(unit, "User=") {
+		t.Errorf("user unit sets User=:\n%s", unit)
+	}
+
+	r := &recordRunner{}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "systemctl --user start myd.service"; len(r.commands) != 1 || r.commands[0] != want {
+		t.Errorf("commands = %q, want %q", r.commands, want)
+	}
+
+	s.Option = KeyValue{optionSessionBus: true}
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("SessionBus accepted for a system service")
+	}
+}
+
+func TestSystemdRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicerepair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+	r := &recordRunner{}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	s := &systemd{Config: &Config{Name: "myd", WithSocket: true, Option: KeyValue{optionUserService: true}}}
+	unitDir := filepath.Join(dir, "systemd", "user")
+	if err = os.MkdirAll(unitDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(unitDir, "myd.service"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.repair(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(unitDir, "myd.socket")); err != nil {
+		t.Errorf("socket file not written: %v", err)
+	}
+	want := "systemctl --user is-enabled --quiet myd.service,systemctl --user daemon-reload"
+	if got := strings.Join(r.commands, ","); got != want {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestSystemdDelegate(t *testing.T) {
+	for v, want := range map[interface{}]string{
+		true:  "Delegate=yes\n",
+		false: "Delegate=no\n",
+	} {
+		s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{optionDelegate: v}}}
+		if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, want) {
+			t.Errorf("unit missing %q:\n%s", want, unit)
+		}
+	}
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{optionDelegate: []string{"cpu", "memory", "pids"}}}}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "Delegate=cpu memory pids\n") {
+		t.Errorf("unit missing controller list:\n%s", unit)
+	}
+
+	s.Option[optionDelegate] = []string{"cpu", "gpu"}
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("unknown controller accepted")
+	}
+}
+
+func TestSystemdCGroup(t *testing.T) {
+	r := &recordRunner{output: "ControlGroup=/system.slice/myd.service\n"}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	cg, err := CGroup(&systemd{Config: &Config{Name: "myd"}})
+	if err != nil || cg != "/system.slice/myd.service" {
+		t.Errorf("CGroup() = %q, %v", cg, err)
+	}
+	if want := "systemctl show --property=ControlGroup -- myd.service"; r.commands[0] != want {
+		t.Errorf("command = %q, want %q", r.commands[0], want)
+	}
+}
+
+func TestSystemdInstallVerified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serviceverified")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+	r := &recordRunner{output: "ActiveState=active\n"}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{optionUserService: true}}}
+	confPath, _ := s.configPath()
+	if err = os.MkdirAll(filepath.Dir(confPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(confPath, []byte("old unit"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backup := filepath.Join(dir, "myd.service.bak")
+	if err = InstallVerified(s, backup); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(backup); string(b) != "old unit" {
+		t.Errorf("backup = %q, want the old unit", b)
+	}
+	if b, _ := ioutil.ReadFile(confPath); !bytes.Contains(b, []byte("[Service]")) {
+		t.Errorf("unit not replaced:\n%s", b)
+	}
+	if got := r.commands[len(r.commands)-2]; got != "systemctl --user restart myd.service" {
+		t.Errorf("second to last command = %q, want restart", got)
+	}
+
+	r.err = errors.New("systemctl failed")
+	err = InstallVerified(s, backup)
+	if err == nil || !strings.Contains(err.Error(), "restore failed") {
+		t.Errorf("failed install and restore: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(confPath); !bytes.Contains(b, []byte("[Service]")) {
+		t.Errorf("previous unit not restored:\n%s", b)
+	}
+}
+
+func TestSystemdInstallProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serviceprogress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+	SetCommandRunner(&recordRunner{})
+	defer SetCommandRunner(nil)
+
+	var steps []string
+	s := &systemd{Config: &Config{Name: "myd", Executable: "/usr/bin/myd", WithSocket: true, SocketListenStream: "8080", Option: KeyValue{
+		optionUserService:  true,
+		optionProgressFunc: func(step string) { steps = append(steps, step) },
+	}}}
+	if err = s.Install(); err != nil {
+		t.Fatal(err)
+	}
+	want := "writing unit file,enabling,writing socket file,reloading daemon"
+	if got := strings.Join(steps, ","); got != want {
+		t.Errorf("steps = %q, want %q", got, want)
+	}
+}
+
+func TestSystemdRestartBackoff(t *testing.T) {
+	r := &recordRunner{output: "systemd 254 (254.5-1)\n+PAM +AUDIT\n"}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{
+		optionRestartSteps:       5,
+		optionRestartMaxDelaySec: 3600,
+	}}}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	if want := "RestartSec=120\nRestartMaxDelaySec=3600\nRestartSteps=5\n"; !strings.Contains(unit, want) {
+		t.Errorf("unit missing %q:\n%s", want, unit)
+	}
+
+	to, err := s.templateData("/usr/bin/myd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.commands) != 0 {
+		t.Errorf("rendering ran %q", r.commands)
+	}
+	if err = checkRestartBackoff(to); err != nil {
+		t.Errorf("systemd 254: %v", err)
+	}
+	r.output = "systemd 249 (249.11-0ubuntu3)\n"
+	if err = checkRestartBackoff(to); err == nil {
+		t.Error("RestartMaxDelaySec accepted for systemd 249")
+	}
+
+	for _, bad := range []KeyValue{
+		{optionRestartSteps: 0, optionRestartMaxDelaySec: 3600},
+		{optionRestartSteps: 5},
+		{optionRestartMaxDelaySec: 60},
+	} {
+		s.Option = bad
+		if _, err := s.templateData("/usr/bin/myd"); err == nil {
+			t.Errorf("options %v accepted", bad)
+		}
+	}
+}
+
+func TestSystemdPurgeData(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{
+		optionStateDirectory: []string{"myd", "myd-extra"},
+		optionLogsDirectory:  []string{"myd"},
+	}}}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	if want := "StateDirectory=myd myd-extra\nLogsDirectory=myd\n"; !strings.Contains(unit, want) {
+		t.Errorf("unit missing %q:\n%s", want, unit)
+	}
+
+	dir, err := ioutil.TempDir("", "servicepurge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("XDG_STATE_HOME", dir)
+	defer os.Unsetenv("XDG_STATE_HOME")
+	s.Option[optionUserService] = true
+	for _, p := range []string{"myd/db", "log/myd", "other"} {
+		if err = os.MkdirAll(filepath.Join(dir, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.purgeData(); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]bool{"myd": false, "log/myd": false, "log": true, "other": true} {
+		if _, err := os.Stat(filepath.Join(dir, p)); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", p, err == nil, want)
+		}
+	}
+
+	for _, bad := range []string{"/", "", "../etc", "/var/lib/myd", "myd/../.."} {
+		s.Option[optionStateDirectory] = []string{bad}
+		if err := s.purgeData(); err == nil {
+			t.Errorf("StateDirectory %q accepted", bad)
+		}
+	}
+}
+
+func TestSystemdLaunchedByManager(t *testing.T) {
+	if id, ok := os.LookupEnv("INVOCATION_ID"); ok {
+		defer os.Setenv("INVOCATION_ID", id)
+	}
+	os.Unsetenv("INVOCATION_ID")
+	s := &systemd{Config: &Config{Name: "myd"}}
+	if LaunchedByManager(s) {
+		t.Error("LaunchedByManager() without INVOCATION_ID = true")
+	}
+	// The test runs in some cgroup, but not in the one of myd.service.
+	os.Setenv("INVOCATION_ID", "0123456789abcdef0123456789abcdef")
+	defer os.Unsetenv("INVOCATION_ID")
+	if LaunchedByManager(s) {
+		t.Error("LaunchedByManager() outside the unit cgroup = true")
+	}
+}
+
+func TestSystemdStartLimitAction(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{optionStartLimitAction: "reboot"}}}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "StartLimitAction=reboot\n") {
+		t.Errorf("unit missing StartLimitAction=reboot:\n%s", unit)
+	}
+	s.Option[optionStartLimitAction] = "explode"
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("unknown StartLimitAction accepted")
+	}
+}
+
+func TestSystemdConditions(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{
+		optionConditionArchitecture:   "x86-64",
+		optionConditionVirtualization: "!container",
+	}}}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	for _, want := range []string{"ConditionArchitecture=x86-64\n", "ConditionVirtualization=!container\n"} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit missing %q:\n%s", want, unit)
+		}
+	}
+	for _, bad := range []KeyValue{
+		{optionConditionArchitecture: "amd64"},
+		{optionConditionVirtualization: "!!vm"},
+	} {
+		s.Option = bad
+		if _, err := s.templateData("/usr/bin/myd"); err == nil {
+			t.Errorf("options %v accepted", bad)
+		}
+	}
+}
+
+func TestSystemdProtectProc(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{
+		optionProtectProc: "invisible",
+		optionProcSubset:  "pid",
+	}}}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	if want := "ProtectProc=invisible\nProcSubset=pid\n"; !strings.Contains(unit, want) {
+		t.Errorf("unit missing %q:\n%s", want, unit)
+	}
+	s.Option[optionProcSubset] = "none"
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("ProcSubset=none accepted")
+	}
+
+	s.Option = KeyValue{optionSecurityPreset: "strict"}
+	if unit = renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "ProtectProc=invisible\nProcSubset=pid\n") {
+		t.Errorf("strict preset unit:\n%s", unit)
+	}
+	s.Option[optionProtectProc] = "ptraceable"
+	if unit = renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "ProtectProc=ptraceable\n") {
+		t.Errorf("ProtectProc does not win over the preset:\n%s", unit)
+	}
+	s.Option = KeyValue{optionSecurityPreset: "paranoid"}
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("unknown SecurityPreset accepted")
+	}
+}
+
+func TestSystemdSocketFileDescriptorName(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", WithSocket: true, SocketListenStream: "8080", SocketFileDescriptorName: "http"}}
+	to, err := s.templateData("/usr/bin/myd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = s.template(systemdSocket).Execute(&buf, to); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ListenStream=8080\nFileDescriptorName=http\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("socket missing %q:\n%s", want, buf.String())
+	}
+
+	s.SocketFileDescriptorName = "http:metrics"
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("name with a colon accepted")
+	}
+}
+
+func TestSystemdUnitFileOwner(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{}}}
+	perm, err := s.unitFilePerm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm.uid != -1 || perm.gid != -1 {
+		t.Errorf("default ownership %d:%d, want -1:-1", perm.uid, perm.gid)
+	}
+
+	s.Option[optionUnitFileOwner] = "root"
+	s.Option[optionUnitFileGroup] = "root"
+	if perm, err = s.unitFilePerm(); err != nil {
+		t.Fatal(err)
+	}
+	if perm.uid != 0 || perm.gid != 0 {
+		t.Errorf("root ownership %d:%d, want 0:0", perm.uid, perm.gid)
+	}
+
+	s.Option[optionUnitFileOwner] = "no-such-user-myd"
+	if _, err = s.unitFilePerm(); err == nil {
+		t.Error("unknown UnitFileOwner accepted")
+	}
+}
+
+func TestSystemdSecretUnitFileMode(t *testing.T) {
+	var warnings []string
+	s := &systemd{Config: &Config{Name: "myd", Arguments: []string{"-db-password", "hunter2"}, Option: KeyValue{
+		optionProgressFunc: func(step string) {
+			if strings.HasPrefix(step, "warning: ") {
+				warnings = append(warnings, step)
+			}
+		},
+	}}}
+	perm, err := s.unitFilePerm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !perm.setMode || perm.mode != 0640 {
+		t.Errorf("mode of unit with a secret = %#o (set %v), want 0640", perm.mode, perm.setMode)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "-db-password") || strings.Contains(warnings[0], "hunter2") {
+		t.Errorf("warnings = %q", warnings)
+	}
+
+	s.Option[optionUnitFileMode] = 0600
+	if perm, err = s.unitFilePerm(); err != nil || perm.mode != 0600 {
+		t.Errorf("explicit UnitFileMode: %#o, %v", perm.mode, err)
+	}
+
+	delete(s.Option, optionUnitFileMode)
+	for _, args := range [][]string{{"TOKEN=abc"}, {"--api-key=abc"}} {
+		s.Arguments = args
+		if perm, err = s.unitFilePerm(); err != nil || perm.mode != 0640 {
+			t.Errorf("arguments %q: mode %#o, %v", args, perm.mode, err)
+		}
+	}
+	s.Arguments = []string{"-config", "/etc/myd/password.conf"}
+	if perm, err = s.unitFilePerm(); err != nil || perm.setMode {
+		t.Errorf("arguments %q: mode %#o set, %v", s.Arguments, perm.mode, err)
+	}
+
+	warnings = nil
+	s.Arguments = []string{"-token", "abc"}
+	s.Option[optionUserService] = true
+	if perm, err = s.unitFilePerm(); err != nil || perm.setMode {
+		t.Errorf("user unit: mode %#o set, %v", perm.mode, err)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("user unit warnings = %q", warnings)
+	}
+}
+
+func TestSystemdCollectMode(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd-setup", Option: KeyValue{
+		optionSystemdType: "oneshot",
+		optionCollectMode: "inactive-or-failed",
+	}}}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	if !strings.Contains(unit, "CollectMode=inactive-or-failed\n") {
+		t.Errorf("unit missing CollectMode=inactive-or-failed:\n%s", unit)
+	}
+	if i, j := strings.Index(unit, "CollectMode="), strings.Index(unit, "[Service]"); i > j {
+		t.Errorf("CollectMode is not in [Unit]:\n%s", unit)
+	}
+	s.Option[optionCollectMode] = "always"
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("CollectMode=always accepted")
+	}
+}
+
+func TestSystemdResourceUsage(t *testing.T) {
+	r := &recordRunner{output: "ActiveState=active\nMemoryCurrent=4194304\nCPUUsageNSec=1500000000\n"}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	s := &systemd{Config: &Config{Name: "myd"}}
+	u, err := Usage(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Memory != 4194304 || u.CPU != 1500*time.Millisecond {
+		t.Errorf("Usage() = %+v", u)
+	}
+
+	r.output = "ActiveState=active\nMemoryCurrent=[not set]\nCPUUsageNSec=[not set]\n"
+	if _, err = Usage(s); err == nil || !strings.Contains(err.Error(), "MemoryAccounting") {
+		t.Errorf("accounting off: err = %v", err)
+	}
+	s.Option = KeyValue{optionMemoryAccounting: false}
+	if _, err = Usage(s); err == nil || !strings.Contains(err.Error(), "MemoryAccounting option is false") {
+		t.Errorf("accounting option false: err = %v", err)
+	}
+	s.Option = nil
+	r.output = "ActiveState=inactive\nMemoryCurrent=[not set]\nCPUUsageNSec=[not set]\n"
+	if _, err = Usage(s); err == nil || !strings.Contains(err.Error(), "not running") {
+		t.Errorf("stopped: err = %v", err)
+	}
+}
+
+func TestSystemdSupplementaryGroups(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", UserName: "myd", Option: KeyValue{
+		optionSupplementaryGroups: []string{"root", "root"},
+	}}}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "SupplementaryGroups=root root\n") {
+		t.Errorf("unit missing SupplementaryGroups:\n%s", unit)
+	}
+	s.Option[optionUserService] = true
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("SupplementaryGroups accepted for a user service")
+	}
+}
+
+func TestSystemdUnmask(t *testing.T) {
+	r := &recordRunner{output: "UnitFileState=masked-runtime\n"}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	if err := Unmask(&systemd{Config: &Config{Name: "myd"}}); err != nil {
+		t.Fatal(err)
+	}
+	want := "systemctl show --property=UnitFileState -- myd.service," +
+		"systemctl unmask --runtime myd.service,systemctl enable myd.service"
+	if got := strings.Join(r.commands, ","); got != want {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestSystemdRestart(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{optionRestart: "on-abnormal"}}}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "Restart=on-abnormal\nRestartSec=120\n") {
+		t.Errorf("unit missing Restart=on-abnormal:\n%s", unit)
+	}
+	s.Option[optionRestart] = "no"
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "Restart=no\n") || strings.Contains(unit, "RestartSec=") {
+		t.Errorf("unit with Restart=no:\n%s", unit)
+	}
+	s.Option[optionRestart] = "sometimes"
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("Restart=sometimes accepted")
+	}
+	s.Option = KeyValue{optionSystemdType: "oneshot", optionRestart: "always"}
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("Restart=always accepted for oneshot")
+	}
+}
+
+func TestSanitizeDirectiveValue(t *testing.T) {
+	for _, c := range []struct {
+		key, value, want string
+		ok               bool
+	}{
+		{"Description", "My daemon", "My daemon", true},
+		{"Description", "  padded\t", "padded", true},
+		{"Environment", "A=b=c", "A=b=c", true},
+		{"Description", "two\nlines", "", false},
+		{"Description", "carriage\rreturn", "", false},
+		{"Description", "continued \\", "", false},
+		{"Exec=Start", "x", "", false},
+		{"", "x", "", false},
+	} {
+		got, err := sanitizeDirectiveValue(c.key, c.value)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("sanitizeDirectiveValue(%q, %q) = %q, %v", c.key, c.value, got, err)
+		}
+	}
+}
+
+func TestSystemdSanitize(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Description: " My daemon "}}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "Description=My daemon\n") {
+		t.Errorf("unit missing trimmed Description:\n%s", unit)
+	}
+	if s.Description != " My daemon " {
+		t.Errorf("Config.Description changed to %q", s.Description)
+	}
+	for _, c := range []*Config{
+		{Name: "myd", Description: "x\nExecStartPre=/bin/sh -c evil"},
+		{Name: "myd", Arguments: []string{"-a\n-b"}},
+		{Name: "myd", WorkingDirectory: "/srv\n"},
+		{Name: "myd", Option: KeyValue{optionPIDFile: "/run/myd.pid\nUser=root"}},
+	} {
+		if _, err := (&systemd{Config: c}).templateData("/usr/bin/myd"); err == nil {
+			t.Errorf("config %+v accepted", c)
+		}
+	}
+}
+
+func TestSystemdExecStartPost(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{
+		optionExecStartPost: []string{"/bin/sh", "-c", "test -S /run/myd.sock"},
+	}}}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, `ExecStartPost=/bin/sh "-c" "test -S /run/myd.sock"`+"\n") {
+		t.Errorf("unit missing ExecStartPost:\n%s", unit)
+	}
+	for _, argv := range [][]string{{"sh", "-c", "true"}, {"/no/such/myd-ready"}, {"/etc"}} {
+		s.Option[optionExecStartPost] = argv
+		if _, err := s.templateData("/usr/bin/myd"); err == nil {
+			t.Errorf("ExecStartPost %q accepted", argv)
+		}
+	}
+}
+
+func TestSystemdIsInit(t *testing.T) {
+	proc, err := ioutil.TempDir("", "serviceproc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(proc)
+	if err = os.Mkdir(filepath.Join(proc, "1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for comm, want := range map[string]bool{"systemd\n": true, "bash\n": false, "tini\n": false} {
+		if err = ioutil.WriteFile(filepath.Join(proc, "1", "comm"), []byte(comm), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := systemdIsInit(proc); got != want {
+			t.Errorf("systemdIsInit with comm %q = %v", comm, got)
+		}
+	}
+
+	if systemdIsInit("/proc") {
+		t.Skip("systemd is PID 1")
+	}
+	s, err := newSystemdService(nil, &Config{Name: "myd", Option: KeyValue{optionStrictSystemdDetection: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*systemd); ok {
+		t.Error("strict detection chose systemd without systemd as PID 1")
+	}
+}
+
+func TestSystemdLinger(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{optionEnableLinger: true}}}
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("EnableLinger accepted for a system service")
+	}
+
+	r := &recordRunner{}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.linger("enable-linger"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "loginctl enable-linger " + u.Username; r.commands[0] != want {
+		t.Errorf("command = %q, want %q", r.commands[0], want)
+	}
+}
+
+func TestSystemdJournalEntries(t *testing.T) {
+	r := &recordRunner{output: `{"__REALTIME_TIMESTAMP":"1700000000000001","PRIORITY":"3","MESSAGE":"failed","CODE":["a","b"]}
+{"PRIORITY":"6","MESSAGE":[104,105]}
+`}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	s := &systemd{Config: &Config{Name: "myd"}}
+	entries, err := JournalEntries(context.Background(), s, map[string]string{"SYSLOG_IDENTIFIER": "myd", "PRIORITY": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "journalctl --unit=myd.service --output=json --no-pager PRIORITY=3 SYSLOG_IDENTIFIER=myd"
+	if len(r.commands) != 1 || r.commands[0] != want {
+		t.Errorf("commands = %q, want %q", r.commands, want)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	e := entries[0]
+	if e.Priority != 3 || e.Message != "failed" || e.Fields["CODE"] != "a" || !e.Time.Equal(time.Unix(1700000000, 1000)) {
+		t.Errorf("entries[0] = %+v", e)
+	}
+	if entries[1].Message != "hi" {
+		t.Errorf("binary MESSAGE = %q, want \"hi\"", entries[1].Message)
+	}
+
+	if _, err = JournalEntries(context.Background(), s, map[string]string{"bad field": "x"}); err == nil {
+		t.Error("invalid field name accepted")
+	}
+}
+
+func TestSystemdFollowJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicejournal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := "#!/bin/sh\nprintf '{\"MESSAGE\":\"%s\"}\\n' \"$*\"\n[ -z \"$MYD_HANG\" ] || exec sleep 60\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "journalctl"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	s := &systemd{Config: &Config{Name: "myd"}}
+	entries, errs, err := FollowJournal(context.Background(), s, map[string]string{"PRIORITY": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for e := range entries {
+		got = append(got, e.Message)
+	}
+	want := "--unit=myd.service --output=json --no-pager --follow --lines=0 PRIORITY=3"
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("messages = %q, want [%q]", got, want)
+	}
+	if err = <-errs; err != nil {
+		t.Errorf("journalctl exiting cleanly reported %v", err)
+	}
+
+	os.Setenv("MYD_HANG", "1")
+	defer os.Unsetenv("MYD_HANG")
+	ctx, cancel := context.WithCancel(context.Background())
+	if entries, errs, err = FollowJournal(ctx, s, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-entries
+	cancel()
+	select {
+	case _, ok := <-entries:
+		if ok {
+			t.Error("entry after cancel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("entries not closed after cancel")
+	}
+	if err = <-errs; err != nil {
+		t.Errorf("cancel reported %v", err)
+	}
+
+	ch := make(chan JournalEntry, 1)
+	if err = readJournal(context.Background(), strings.NewReader("not json\n"), ch); err == nil {
+		t.Error("invalid journal line accepted")
+	}
+}
+
+func TestSystemdStartedAt(t *testing.T) {
+	r := &recordRunner{output: "ActiveState=active\nExecMainStartTimestamp=Tue 2023-11-14 22:13:20 UTC\nActiveEnterTimestamp=Tue 2023-11-14 22:13:19 UTC\n"}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	s := &systemd{Config: &Config{Name: "myd"}}
+	at, err := StartedAt(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !at.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("StartedAt() = %v", at)
+	}
+
+	r.output = "ActiveState=active\nExecMainStartTimestamp=\nActiveEnterTimestamp=Tue 2023-11-14 22:13:19 UTC\n"
+	if at, err = StartedAt(s); err != nil || !at.Equal(time.Unix(1699999999, 0)) {
+		t.Errorf("without main process: StartedAt() = %v, %v", at, err)
+	}
+	r.output = "ActiveState=inactive\nExecMainStartTimestamp=\nActiveEnterTimestamp=\n"
+	if at, err = StartedAt(s); err == nil || !at.IsZero() {
+		t.Errorf("stopped: StartedAt() = %v, %v", at, err)
+	}
+}
+
+func TestSystemdOnFailure(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{
+		optionOnFailure:        []string{"ops-alert@myd.service"},
+		optionOnFailureCommand: []string{"/bin/sh", "-c", "logger myd failed"},
+	}}}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "OnFailure=ops-alert@myd.service myd-failure-notify.service\n") {
+		t.Errorf("unit missing OnFailure:\n%s", unit)
+	}
+	to, err := s.templateData("/usr/bin/myd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = s.template(systemdFailureNotify).Execute(&buf, to); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `ExecStart=/bin/sh "-c" "logger myd failed"`+"\n") {
+		t.Errorf("failure handler missing ExecStart:\n%s", buf.String())
+	}
+
+	s.Option[optionOnFailureCommand] = []string{"/bin/sh", "-c", "logger myd failed\nUser=root"}
+	if _, err = s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("OnFailureCommand with a newline accepted")
+	}
+
+	s.Option[optionOnFailureCommand] = []string{"/bin/sh", "-c", "logger myd failed"}
+	s.Option[optionOnFailure] = []string{"not a unit"}
+	if _, err = s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("invalid OnFailure unit accepted")
+	}
+}
+
+func TestSystemdAccounting(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{
+		optionMemoryAccounting: true,
+		optionIOAccounting:     false,
+	}}}
+	unit := renderSystemd(t, s, "/usr/bin/myd")
+	if !strings.Contains(unit, "MemoryAccounting=yes\nIOAccounting=no\n") {
+		t.Errorf("unit missing accounting:\n%s", unit)
+	}
+	if strings.Contains(unit, "CPUAccounting") || strings.Contains(unit, "TasksAccounting") {
+		t.Errorf("unit has unset accounting options:\n%s", unit)
+	}
+	s.Option[optionTasksAccounting] = "yes"
+	if _, err := s.templateData("/usr/bin/myd"); err == nil {
+		t.Error("TasksAccounting string accepted")
+	}
+}
+
+func TestSystemdPrivateNetwork(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", WithSocket: true, Option: KeyValue{optionPrivateNetwork: true}}}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "PrivateNetwork=yes\n") || !strings.Contains(unit, "Requires=myd.socket\n") {
+		t.Errorf("unit missing PrivateNetwork with socket:\n%s", unit)
+	}
+	s.Option[optionPrivateNetwork] = false
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); strings.Contains(unit, "PrivateNetwork") {
+		t.Errorf("unit has PrivateNetwork when off:\n%s", unit)
+	}
+
+	dir, err := ioutil.TempDir("", "serviceprivnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+	SetCommandRunner(&recordRunner{})
+	defer SetCommandRunner(nil)
+	var warnings []string
+	s = &systemd{Config: &Config{Name: "myd", Executable: "/usr/bin/myd", Option: KeyValue{
+		optionUserService:    true,
+		optionPrivateNetwork: true,
+		optionProgressFunc: func(step string) {
+			if strings.HasPrefix(step, "warning: ") {
+				warnings = append(warnings, step)
+			}
+		},
+	}}}
+	if err = s.Install(); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "PrivateNetwork without WithSocket") {
+		t.Errorf("warnings = %q", warnings)
+	}
+}
+
+func TestSystemdTransitioning(t *testing.T) {
+	r := &recordRunner{}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	s := &systemd{Config: &Config{Name: "myd"}}
+	for output, want := range map[string]bool{
+		"ActiveState=active\nSubState=running\n":            false,
+		"ActiveState=inactive\nSubState=dead\n":             false,
+		"ActiveState=activating\nSubState=start\n":          true,
+		"ActiveState=deactivating\nSubState=stop-sigterm\n": true,
+		"ActiveState=failed\nSubState=auto-restart\n":       true,
+	} {
+		r.output = output
+		got, err := IsTransitioning(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("IsTransitioning with %q = %v, want %v", output, got, want)
+		}
+	}
+}
+
+func TestSystemdRestartOnCleanExit(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{}}}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "Restart=on-failure\n") {
+		t.Errorf("default unit missing Restart=on-failure:\n%s", unit)
+	}
+	s.Option[optionRestartOnCleanExit] = true
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "Restart=always\n") {
+		t.Errorf("unit missing Restart=always:\n%s", unit)
+	}
+}
+
+func TestSystemdBundle(t *testing.T) {
+	s := &systemd{Config: &Config{Name: "myd", Executable: "/opt/myd/bin/myd", WithSocket: true, SocketListenStream: "8080"}}
+	var buf bytes.Buffer
+	if err := Bundle(s, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &recordRunner{}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+	root, err := ioutil.TempDir("", "servicebundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	bundle := buf.Bytes()
+	if err = installBundle(bytes.NewReader(bundle), root); err != nil {
+		t.Fatal(err)
+	}
+	unit, err := ioutil.ReadFile(filepath.Join(root, "etc/systemd/system/myd.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(unit), "ExecStart=/opt/myd/bin/myd\n") {
+		t.Errorf("bundled unit:\n%s", unit)
+	}
+	if _, err = os.Stat(filepath.Join(root, "etc/systemd/system/myd.socket")); err != nil {
+		t.Error(err)
+	}
+	want := "systemctl daemon-reload,systemctl enable myd.service"
+	if got := strings.Join(r.commands, ","); got != want {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+
+	r.commands = nil
+	if err = installBundle(bytes.NewReader(bundle), root); err == nil {
+		t.Error("bundle installed over existing files")
+	}
+	if len(r.commands) != 0 {
+		t.Errorf("commands run for a refused bundle: %q", r.commands)
+	}
+
+	var tampered bytes.Buffer
+	tw := tar.NewWriter(&tampered)
+	manifest := []byte(`{"files": [], "commands": [["rm", "-rf", "/"]]}`)
+	tw.WriteHeader(&tar.Header{Name: bundleManifestName, Mode: 0644, Size: int64(len(manifest))})
+	tw.Write(manifest)
+	tw.Close()
+	if err = installBundle(&tampered, root); err == nil || len(r.commands) != 0 {
+		t.Errorf("bundle with rm command: err = %v, commands = %q", err, r.commands)
+	}
+
+	for _, name := range []string{"../etc/systemd/system/evil.service", "etc/sudoers.d/myd", "root/.ssh/authorized_keys"} {
+		if err = installBundle(bytes.NewReader(tarBundle(t, name, nil)), root); err == nil {
+			t.Errorf("bundle entry %q accepted", name)
+		}
+	}
+
+	linked, err := ioutil.TempDir("", "servicebundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(linked)
+	for _, dir := range []string{"etc/systemd", "elsewhere"} {
+		if err = os.MkdirAll(filepath.Join(linked, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Symlink(filepath.Join(linked, "elsewhere"), filepath.Join(linked, "etc/systemd/system")); err != nil {
+		t.Fatal(err)
+	}
+	if err = installBundle(bytes.NewReader(bundle), linked); err == nil {
+		t.Error("bundle written through a symbolic link")
+	}
+
+	fresh, err := ioutil.TempDir("", "servicebundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(fresh)
+	r.err = errors.New("daemon-reload failed")
+	if err = installBundle(bytes.NewReader(bundle), fresh); err != r.err {
+		t.Errorf("installBundle = %v, want %v", err, r.err)
+	}
+	if _, err = os.Stat(filepath.Join(fresh, "etc/systemd/system/myd.service")); !os.IsNotExist(err) {
+		t.Errorf("unit left behind after a failed command: %v", err)
+	}
+
+	const unitName = "etc/systemd/system/myd.service"
+	for _, argv := range [][]string{
+		{"systemctl", "poweroff"},
+		{"systemctl", "mask", "sshd.service"},
+		{"systemctl", "enable", "sshd.service"},
+		{"systemctl", "enable", "--now", "myd.service"},
+		{"apparmor_parser", "-R", "/etc/apparmor.d/anything"},
+		{"apparmor_parser", "-r", "/etc/apparmor.d/anything"},
+	} {
+		r.commands = nil
+		if err = installBundle(bytes.NewReader(tarBundle(t, unitName, [][]string{argv})), fresh); err == nil || len(r.commands) != 0 {
+			t.Errorf("bundle with %q: err = %v, commands = %q", argv, err, r.commands)
+		}
+	}
+
+	r.commands = nil
+	r.failOn = "systemctl daemon-reload"
+	commands := [][]string{{"systemctl", "enable", "myd.service"}, {"systemctl", "daemon-reload"}}
+	if err = installBundle(bytes.NewReader(tarBundle(t, unitName, commands)), fresh); err != r.err {
+		t.Errorf("installBundle = %v, want %v", err, r.err)
+	}
+	want = "systemctl enable myd.service,systemctl daemon-reload,systemctl disable myd.service"
+	if got := strings.Join(r.commands, ","); got != want {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+	if _, err = os.Stat(filepath.Join(fresh, unitName)); !os.IsNotExist(err) {
+		t.Errorf("unit left behind after a failed command: %v", err)
+	}
+
+	s.Option = KeyValue{optionUserService: true}
+	if err = Bundle(s, ioutil.Discard); err == nil {
+		t.Error("user service bundled")
+	}
+}
+
+// tarBundle returns a bundle that lists and holds the single file name and
+// runs commands.
+func tarBundle(t *testing.T, name string, commands [][]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if commands == nil {
+		commands = [][]string{}
+	}
+	manifest, err := json.Marshal(bundleManifest{Files: []string{name}, Commands: commands})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("[Service]\n")
+	if err := tw.WriteHeader(&tar.Header{Name: bundleManifestName, Mode: 0644, Size: int64(len(manifest))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(manifest)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(data)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSystemdVerifyBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serviceverify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+	exe := filepath.Join(dir, "myd")
+	if err = ioutil.WriteFile(exe, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &systemd{Config: &Config{Name: "myd", Executable: exe, Option: KeyValue{optionUserService: true}}}
+	if err = VerifyBinary(s); err == nil {
+		t.Error("VerifyBinary succeeded without an installed unit")
+	}
+	confPath, _ := s.configPath()
+	if err = os.MkdirAll(filepath.Dir(confPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(confPath, []byte("[Unit]\nConditionFileIsExecutable="+exe+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyBinary(s); err != nil {
+		t.Errorf("installed executable: %v", err)
+	}
+
+	// SHA-256 of "#!/bin/sh\n".
+	s.Option[optionExpectedChecksum] = "a8076d3d28d21e02012b20eaf7dbf75409a6277134439025f282e368e3305abf"
+	if err = VerifyBinary(s); err != nil {
+		t.Errorf("matching checksum: %v", err)
+	}
+	s.Option[optionExpectedChecksum] = strings.Repeat("0", 64)
+	if err = VerifyBinary(s); err == nil {
+		t.Error("wrong checksum accepted")
+	}
+	delete(s.Option, optionExpectedChecksum)
+
+	if err = os.Chmod(exe, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyBinary(s); err == nil {
+		t.Error("file that is not executable accepted")
+	}
+	s.Executable = filepath.Join(dir, "myd-2")
+	if err = VerifyBinary(s); err == nil {
+		t.Error("unit running another executable accepted")
+	}
+}
+
+func TestSystemdAppArmor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serviceapparmor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d, f string) { appArmorDir, appArmorEnabledFile = d, f }(appArmorDir, appArmorEnabledFile)
+	appArmorDir = dir + "/apparmor.d/"
+	appArmorEnabledFile = filepath.Join(dir, "enabled")
+	if err = os.Mkdir(appArmorDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "usr.bin.myd")
+	if err = ioutil.WriteFile(src, []byte("profile myd /usr/bin/myd {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := &recordRunner{}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{
+		optionAppArmorProfile:     "myd",
+		optionAppArmorProfilePath: src,
+	}}}
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); !strings.Contains(unit, "\nAppArmorProfile=myd\n") {
+		t.Errorf("unit missing AppArmorProfile:\n%s", unit)
+	}
+	dest := appArmorDir + "usr.bin.myd"
+
+	// Without AppArmor the profile is neither copied nor loaded.
+	if err = s.installAppArmorProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(dest); !os.IsNotExist(err) || len(r.commands) != 0 {
+		t.Errorf("profile installed without AppArmor: %v, %q", err, r.commands)
+	}
+
+	if err = ioutil.WriteFile(appArmorEnabledFile, []byte("Y\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.installAppArmorProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(dest); !bytes.Contains(b, []byte("profile myd")) {
+		t.Errorf("profile copied as %q", b)
+	}
+	if err = s.removeAppArmorProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("profile left behind: %v", err)
+	}
+	want := "apparmor_parser -r " + dest + ",apparmor_parser -R " + dest
+	if got := strings.Join(r.commands, ","); got != want {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+
+	s.Option[optionUserService] = true
+	if dest := s.appArmorProfileDest(); len(dest) != 0 {
+		t.Errorf("user service profile destination %q", dest)
+	}
+	s.Option[optionAppArmorProfile] = "myd\nUser=root"
+	if unit := renderSystemd(t, s, "/usr/bin/myd"); strings.Contains(unit, "\nUser=root") {
+		t.Errorf("AppArmorProfile injected a directive:\n%s", unit)
+	}
+}
+
+func TestSystemdLenientDaemonReload(t *testing.T) {
+	r := &recordRunner{err: errors.New("Failed to reload daemon: Access denied")}
+	SetCommandRunner(r)
+	defer SetCommandRunner(nil)
+
+	s := &systemd{Config: &Config{Name: "myd", Option: KeyValue{}}}
+	if err := s.daemonReload(); err != r.err {
+		t.Errorf("daemonReload = %v, want %v", err, r.err)
+	}
+	s.Option[optionLenientDaemonReload] = true
+	if err := s.daemonReload(); err != nil {
+		t.Errorf("lenient daemonReload = %v", err)
+	}
+	r.err = nil
+	if err := s.daemonReload(); err != nil {
+		t.Errorf("daemonReload = %v", err)
+	}
+	if want := "systemctl daemon-reload"; len(r.commands) != 3 || r.commands[2] != want {
+		t.Errorf("commands = %q, want 3 of %q", r.commands, want)
+	}
+}
@@ -7,13 +7,31 @@ package service
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/signal"
 	"syscall"
 	"text/template"
 	"time"
 )
 
+// sysvStatusAll runs the status action of each installed init script;
+// SysV has no way to query several services at once.
+func sysvStatusAll(names []string) (map[string]Status, error) {
+	status := make(map[string]Status, len(names))
+	for _, name := range names {
+		if _, err := os.Stat("/etc/init.d/" + name); err != nil {
+			continue
+		}
+		// Scripts written by this package exit 1 when stopped.
+		if run("service", name, "status") == nil {
+			status[name] = StatusRunning
+		} else {
+			status[name] = StatusStopped
+		}
+	}
+	return status, nil
+}
+
 type sysv struct {
 	i Interface
 	*Config
@@ -35,6 +53,10 @@ func (s *sysv) String() string {
 	return s.Name
 }
 
+func (s *sysv) program() Interface {
+	return s.i
+}
+
 var errNoUserServiceSystemV = errors.New("User services are not supported on SystemV.")
 
 func (s *sysv) configPath() (cp string, err error) {
@@ -49,6 +71,77 @@ func (s *sysv) template() *template.Template {
 	return template.Must(template.New("").Funcs(tf).Parse(sysvScript))
 }
 
+// sysvDefaultStopTimeout is how long the init script waits for the
+// process to exit unless the StopTimeout option is set.
+const sysvDefaultStopTimeout = 10 * time.Second
+
+func (s *sysv) stopTimeout() time.Duration {
+	return s.timeout(optionStopTimeout, sysvDefaultStopTimeout)
+}
+
+// listeningPorts reads the process ID from the pid file of the init script.
+func (s *sysv) listeningPorts() ([]string, error) {
+	pid, err := readPIDFile("/var/run/" + s.Name + ".pid")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return procListening(pid)
+}
+
+func (s *sysv) resourceUsage() (ResourceUsage, error) {
+	pid, err := readPIDFile("/var/run/" + s.Name + ".pid")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ResourceUsage{}, fmt.Errorf("%s is not running.", s.Name)
+		}
+		return ResourceUsage{}, err
+	}
+	return procUsage(pid)
+}
+
+func (s *sysv) startedAt() (time.Time, error) {
+	pid, err := readPIDFile("/var/run/" + s.Name + ".pid")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, fmt.Errorf("%s is not running.", s.Name)
+		}
+		return time.Time{}, err
+	}
+	return procStartTime(pid)
+}
+
+func (s *sysv) render(w io.Writer, path string) error {
+	setpriv, err := setprivPrefix(s.Option, "")
+	if err != nil {
+		return err
+	}
+	var to = &struct {
+		*Config
+		Path        string
+		StopSeconds int
+		Setpriv     string
+	}{
+		s.Config,
+		path,
+		seconds(s.stopTimeout()),
+		setpriv,
+	}
+	return s.template().Execute(w, to)
+}
+
+// installedPath reads the executable from the processname header of the
+// installed init script.
+func (s *sysv) installedPath() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	return readPrefixedLine(cp, "# processname: ")
+}
+
 func (s *sysv) Install() error {
 	confPath, err := s.configPath()
 	if err != nil {
@@ -58,7 +151,11 @@ func (s *sysv) Install() error {
 	if err == nil {
 		return fmt.Errorf("Init already exists: %s", confPath)
 	}
+	if _, err = supplementaryGroups(s.Option); err != nil {
+		return err
+	}
 
+	s.progress("writing init script")
 	f, err := os.Create(confPath)
 	if err != nil {
 		return err
@@ -70,15 +167,7 @@ func (s *sysv) Install() error {
 		return err
 	}
 
-	var to = &struct {
-		*Config
-		Path string
-	}{
-		s.Config,
-		path,
-	}
-
-	err = s.template().Execute(f, to)
+	err = s.render(f, path)
 	if err != nil {
 		return err
 	}
@@ -86,17 +175,39 @@ func (s *sysv) Install() error {
 	if err = os.Chmod(confPath, 0755); err != nil {
 		return err
 	}
+	s.progress("linking runlevels")
+	s.linkRunlevels(confPath)
+	return nil
+}
+
+// linkRunlevels links the init script into the rc directories, skipping
+// links that exist.
+func (s *sysv) linkRunlevels(confPath string) {
 	for _, i := range [...]string{"2", "3", "4", "5"} {
-		if err = os.Symlink(confPath, "/etc/rc"+i+".d/S50"+s.Name); err != nil {
+		if err := os.Symlink(confPath, "/etc/rc"+i+".d/S50"+s.Name); err != nil {
 			continue
 		}
 	}
 	for _, i := range [...]string{"0", "1", "6"} {
-		if err = os.Symlink(confPath, "/etc/rc"+i+".d/K02"+s.Name); err != nil {
+		if err := os.Symlink(confPath, "/etc/rc"+i+".d/K02"+s.Name); err != nil {
 			continue
 		}
 	}
+}
 
+// repair installs again if the init script is missing, and otherwise
+// restores missing runlevel links.
+func (s *sysv) repair() error {
+	confPath, err := s.configPath()
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(confPath); os.IsNotExist(err) {
+		s.progress("repair: init script missing, installing again")
+		return s.Install()
+	}
+	s.progress("repair: linking runlevels")
+	s.linkRunlevels(confPath)
 	return nil
 }
 
@@ -118,21 +229,34 @@ func (s *sysv) Logger(errs chan<- error) (Logger, error) {
 	return s.SystemLogger(errs)
 }
 func (s *sysv) SystemLogger(errs chan<- error) (Logger, error) {
-	return newSysLogger(s.Name, errs)
+	return newSysLogger(s.Name, s.Option, errs)
 }
 
 func (s *sysv) Run() (err error) {
+	var sig os.Signal
+	defer func() { err = reraise(s.Config, sig, err) }()
+	defer redirectOutput(s, s.Config)()
+	states := s.states()
+	defer states.set(StateStopped)
+
+	if err = setIOScheduling(s.Option); err != nil {
+		return err
+	}
+	if err = joinCGroup(cgroupRoot, s.Name, s.Option); err != nil {
+		return err
+	}
+
+	states.set(StateStarting)
 	err = s.i.Start(s)
 	if err != nil {
 		return err
 	}
+	states.set(StateRunning)
 
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
-		<-sigChan
-	})()
+	sig = runWait(s, s.Config, s.i, syscall.SIGTERM, os.Interrupt)
+	states.set(StateStopping)
 
+	drain(s, s.i, s.stopTimeout())
 	return s.i.Stop(s)
 }
 
@@ -153,6 +277,12 @@ func (s *sysv) Restart() error {
 	return s.Start()
 }
 
+// The init script is the only thing service can run for a name,
+// so no verb needs to be refused.
+func (s *sysv) exec(args ...string) (string, error) {
+	return runCombined("service", append([]string{s.Name}, args...)...)
+}
+
 const sysvScript = `#!/bin/sh
 # For RedHat and cousins:
 # chkconfig: - 99 01
@@ -169,8 +299,6 @@ const sysvScript = `#!/bin/sh
 # Description:       {{.Description}}
 ### END INIT INFO
 
-cmd="{{.Path}}{{range .Arguments}} {{.|cmd}}{{end}}"
-
 name=$(basename $(readlink -f $0))
 pid_file="/var/run/$name.pid"
 stdout_log="/var/log/$name.log"
@@ -192,8 +320,8 @@ case "$1" in
             echo "Already started"
         else
             echo "Starting $name"
-            {{if .WorkingDirectory}}cd '{{.WorkingDirectory}}'{{end}}
-            $cmd >> "$stdout_log" 2>> "$stderr_log" &
+            {{if .WorkingDirectory}}cd {{.WorkingDirectory|shellQuote}}{{end}}
+            {{.Setpriv}}{{.Path|shellQuote}}{{range .Arguments}} {{.|shellQuote}}{{end}} >> "$stdout_log" 2>> "$stderr_log" &
             echo $! > "$pid_file"
             if ! is_running; then
                 echo "Unable to start, see $stdout_log and $stderr_log"
@@ -205,7 +333,7 @@ case "$1" in
         if is_running; then
             echo -n "Stopping $name.."
             kill $(get_pid)
-            for i in $(seq 1 10)
+            for i in $(seq 1 {{.StopSeconds}})
             do
                 if ! is_running; then
                     break
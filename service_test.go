@@ -5,6 +5,9 @@
 package service_test
 
 import (
+	"errors"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -40,6 +43,25 @@ func TestRunInterrupt(t *testing.T) {
 	}
 }
 
+func TestBegin(t *testing.T) {
+	p := &program{}
+	s, err := service.New(p, &service.Config{Name: "go_service_test"})
+	if err != nil {
+		t.Fatalf("New err: %s", err)
+	}
+	stop, err := service.Begin(s)
+	if err != nil {
+		t.Fatalf("Begin() err: %s", err)
+	}
+	if err = stop(); err != nil {
+		t.Fatalf("stop() err: %s", err)
+	}
+	stop()
+	if p.numStopped != 1 {
+		t.Errorf("numStopped = %d, want 1", p.numStopped)
+	}
+}
+
 type program struct {
 	numStopped int
 }
@@ -55,3 +77,184 @@ func (p *program) Stop(s service.Service) error {
 	p.numStopped++
 	return nil
 }
+
+type fakeSystem struct {
+	name   string
+	detect bool
+}
+
+func (f fakeSystem) String() string    { return f.name }
+func (f fakeSystem) Detect() bool      { return f.detect }
+func (f fakeSystem) Interactive() bool { return true }
+func (f fakeSystem) New(i service.Interface, c *service.Config) (service.Service, error) {
+	return nil, service.ErrNotSupported
+}
+
+func TestAddSystem(t *testing.T) {
+	builtin := service.AvailableSystems()
+	defer service.ChooseSystem(builtin...)
+
+	service.ChooseSystem(fakeSystem{name: "absent"})
+	service.AddSystem(fakeSystem{name: "custom-init", detect: true})
+	if got := len(service.AvailableSystems()); got != 2 {
+		t.Fatalf("%d systems available, want 2", got)
+	}
+	if got := service.ChosenSystem(); got == nil || got.String() != "custom-init" {
+		t.Errorf("chose %v, want custom-init", got)
+	}
+}
+
+func TestInitOverride(t *testing.T) {
+	builtin := service.AvailableSystems()
+	defer service.ChooseSystem(builtin...)
+	defer os.Unsetenv("SERVICE_INIT_OVERRIDE")
+
+	os.Setenv("SERVICE_INIT_OVERRIDE", "custom-init")
+	service.ChooseSystem(fakeSystem{name: "detected", detect: true}, fakeSystem{name: "custom-init"})
+	if got := service.ChosenSystem(); got == nil || got.String() != "custom-init" {
+		t.Errorf("chose %v, want custom-init", got)
+	}
+	service.AddSystem(fakeSystem{name: "added", detect: true})
+	if got := service.ChosenSystem(); got == nil || got.String() != "custom-init" {
+		t.Errorf("chose %v after AddSystem, want custom-init", got)
+	}
+
+	os.Setenv("SERVICE_INIT_OVERRIDE", "custom-inti")
+	service.ChooseSystem(fakeSystem{name: "detected", detect: true})
+	if _, err := service.New(nil, &service.Config{Name: "myd"}); err == nil || !strings.Contains(err.Error(), "custom-inti") {
+		t.Errorf("New with an unknown override = %v", err)
+	}
+}
+
+// configSystem records the Config that New receives.
+type configSystem struct {
+	fakeSystem
+	config **service.Config
+}
+
+func (s configSystem) New(i service.Interface, c *service.Config) (service.Service, error) {
+	*s.config = c
+	return nil, service.ErrNotSupported
+}
+
+func TestInstallPrefix(t *testing.T) {
+	builtin := service.AvailableSystems()
+	defer service.ChooseSystem(builtin...)
+	var got *service.Config
+	service.ChooseSystem(configSystem{fakeSystem{name: "custom-init", detect: true}, &got})
+
+	c := &service.Config{
+		Name:             "myd",
+		Executable:       "${PREFIX}/bin/myd",
+		WorkingDirectory: "${PREFIX}/var",
+		ChRoot:           "${PREFIX}",
+		Arguments:        []string{"-config", "${PREFIX}/etc/myd.conf"},
+		Option:           service.KeyValue{"InstallPrefix": "/opt/myd"},
+	}
+	service.New(nil, c)
+	if got == nil {
+		t.Fatal("New did not reach the system")
+	}
+	if got.Executable != "/opt/myd/bin/myd" || got.WorkingDirectory != "/opt/myd/var" || got.ChRoot != "/opt/myd" {
+		t.Errorf("paths = %q, %q, %q", got.Executable, got.WorkingDirectory, got.ChRoot)
+	}
+	if want := "-config /opt/myd/etc/myd.conf"; strings.Join(got.Arguments, " ") != want {
+		t.Errorf("Arguments = %q, want %q", got.Arguments, want)
+	}
+	if c.Executable != "${PREFIX}/bin/myd" || c.Arguments[1] != "${PREFIX}/etc/myd.conf" {
+		t.Errorf("New changed the caller's Config: %+v", c)
+	}
+}
+
+// fakeService records Install and Uninstall calls to log.
+type fakeService struct {
+	name       string
+	log        *[]string
+	installErr error
+}
+
+func (f fakeService) Run() error     { return nil }
+func (f fakeService) Start() error   { return nil }
+func (f fakeService) Stop() error    { return nil }
+func (f fakeService) Restart() error { return nil }
+func (f fakeService) Install() error {
+	*f.log = append(*f.log, "install "+f.name)
+	return f.installErr
+}
+func (f fakeService) Uninstall() error {
+	*f.log = append(*f.log, "uninstall "+f.name)
+	return nil
+}
+func (f fakeService) Logger(errs chan<- error) (service.Logger, error)       { return nil, nil }
+func (f fakeService) SystemLogger(errs chan<- error) (service.Logger, error) { return nil, nil }
+func (f fakeService) String() string                                         { return f.name }
+
+func TestGroupInstallTx(t *testing.T) {
+	var log []string
+	g := service.Group{
+		fakeService{name: "db", log: &log},
+		fakeService{name: "api", log: &log},
+		fakeService{name: "web", log: &log, installErr: errors.New("disk full")},
+	}
+	if err := g.InstallTx(); err == nil || !strings.Contains(err.Error(), "web") {
+		t.Errorf("InstallTx() = %v, want failure of web", err)
+	}
+	want := "install db,install api,install web,uninstall api,uninstall db"
+	if got := strings.Join(log, ","); got != want {
+		t.Errorf("calls = %q, want %q", got, want)
+	}
+}
+
+type restartPolicy string
+
+func TestConfigFromStruct(t *testing.T) {
+	keepAlive := false
+	c, err := service.ConfigFromStruct(&struct {
+		Name        string        `service:"Name"`
+		Args        []string      `service:"Arguments"`
+		Restart     restartPolicy `service:"Restart"`
+		StopTimeout time.Duration `service:"StopTimeout,omitempty"`
+		KeepAlive   *bool         `service:"KeepAlive"`
+		RunAtLoad   *bool         `service:"RunAtLoad"`
+		Internal    int
+	}{
+		Name:      "myd",
+		Args:      []string{"-config", "/etc/myd.conf"},
+		Restart:   "on-failure",
+		KeepAlive: &keepAlive,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "myd" || len(c.Arguments) != 2 {
+		t.Errorf("Config = %+v", c)
+	}
+	if v, ok := c.Option["Restart"].(string); !ok || v != "on-failure" {
+		t.Errorf("Restart = %#v, want the string on-failure", c.Option["Restart"])
+	}
+	if v, ok := c.Option["KeepAlive"].(bool); !ok || v {
+		t.Errorf("KeepAlive = %#v, want false", c.Option["KeepAlive"])
+	}
+	for _, name := range []string{"StopTimeout", "RunAtLoad"} {
+		if _, ok := c.Option[name]; ok {
+			t.Errorf("unset %s is in Option", name)
+		}
+	}
+
+	for _, bad := range []interface{}{
+		struct {
+			RestartSec int `service:"RestartSecs"`
+		}{},
+		struct {
+			StopTimeout int `service:"StopTimeout"`
+		}{},
+		struct {
+			Name int `service:"Name"`
+		}{},
+		"myd",
+	} {
+		if _, err = service.ConfigFromStruct(bad); err == nil {
+			t.Errorf("ConfigFromStruct(%#v) succeeded", bad)
+		}
+	}
+}
@@ -7,23 +7,116 @@
 package service
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log/syslog"
-	"os/exec"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
-func newSysLogger(name string, errs chan<- error) (Logger, error) {
-	w, err := syslog.New(syslog.LOG_INFO, name)
+// syslogNew connects to syslog with tag, at raddr over network or through
+// the local socket if network is empty; tests replace it.
+var syslogNew = func(network, raddr, tag string) (*syslog.Writer, error) {
+	return syslog.Dial(network, raddr, syslog.LOG_INFO, tag)
+}
+
+// syslogAddress parses the SyslogAddress option, such as
+// "udp://logs.example:514", into the network and address for syslog.Dial.
+// The port defaults to 514.
+func syslogAddress(kv KeyValue) (network, raddr string, err error) {
+	addr := kv.string(optionSyslogAddress, "")
+	if len(addr) == 0 {
+		return "", "", nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("%s %q: %v", optionSyslogAddress, addr, err)
+	}
+	switch u.Scheme {
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+	default:
+		return "", "", fmt.Errorf("%s %q must be a udp:// or tcp:// URL.", optionSyslogAddress, addr)
+	}
+	if len(u.Hostname()) == 0 || len(u.Path) != 0 {
+		return "", "", fmt.Errorf("%s %q must be a host and optional port.", optionSyslogAddress, addr)
+	}
+	raddr = u.Host
+	if len(u.Port()) == 0 {
+		raddr = net.JoinHostPort(u.Hostname(), "514")
+	}
+	return u.Scheme, raddr, nil
+}
+
+// newSysLogger returns a logger tagged with name, or for each level with
+// the tag the LogIdentifierByLevel option sets for it. A writer that fails
+// to write, as when a SyslogAddress server restarts, connects again and
+// retries the message once; if that fails too the error is sent on errs and
+// the next message tries again.
+func newSysLogger(name string, kv KeyValue, errs chan<- error) (Logger, error) {
+	tags, _ := kv[optionLogIdentifierByLevel].(map[string]string)
+	for level := range tags {
+		if level != "error" && level != "warning" && level != "info" {
+			return nil, fmt.Errorf("%s level %q must be error, warning or info.", optionLogIdentifierByLevel, level)
+		}
+	}
+	network, raddr, err := syslogAddress(kv)
 	if err != nil {
 		return nil, err
 	}
-	return sysLogger{w, errs}, nil
+	s := sysLogger{errs: errs}
+	// Levels with the same tag share a connection.
+	writers := map[string]*syslog.Writer{}
+	for _, l := range []struct {
+		level  string
+		writer **syslog.Writer
+	}{
+		{"error", &s.err},
+		{"warning", &s.warning},
+		{"info", &s.info},
+	} {
+		tag := name
+		if t := tags[l.level]; len(t) != 0 {
+			tag = t
+		}
+		w, ok := writers[tag]
+		if !ok {
+			if w, err = syslogNew(network, raddr, tag); err != nil {
+				for _, w := range writers {
+					w.Close()
+				}
+				return nil, err
+			}
+			writers[tag] = w
+		}
+		*l.writer = w
+	}
+	return s, nil
 }
 
 type sysLogger struct {
-	*syslog.Writer
-	errs chan<- error
+	err, warning, info *syslog.Writer
+	errs               chan<- error
+}
+
+// Close closes the connections of the logger, once each.
+func (s sysLogger) Close() error {
+	var err error
+	closed := map[*syslog.Writer]bool{}
+	for _, w := range []*syslog.Writer{s.err, s.warning, s.info} {
+		if w == nil || closed[w] {
+			continue
+		}
+		closed[w] = true
+		if cerr := w.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 func (s sysLogger) send(err error) error {
@@ -34,55 +127,246 @@ func (s sysLogger) send(err error) error {
 }
 
 func (s sysLogger) Error(v ...interface{}) error {
-	return s.send(s.Writer.Err(fmt.Sprint(v...)))
+	return s.send(s.err.Err(fmt.Sprint(v...)))
 }
 func (s sysLogger) Warning(v ...interface{}) error {
-	return s.send(s.Writer.Warning(fmt.Sprint(v...)))
+	return s.send(s.warning.Warning(fmt.Sprint(v...)))
 }
 func (s sysLogger) Info(v ...interface{}) error {
-	return s.send(s.Writer.Info(fmt.Sprint(v...)))
+	return s.send(s.info.Info(fmt.Sprint(v...)))
 }
 func (s sysLogger) Errorf(format string, a ...interface{}) error {
-	return s.send(s.Writer.Err(fmt.Sprintf(format, a...)))
+	return s.send(s.err.Err(fmt.Sprintf(format, a...)))
 }
 func (s sysLogger) Warningf(format string, a ...interface{}) error {
-	return s.send(s.Writer.Warning(fmt.Sprintf(format, a...)))
+	return s.send(s.warning.Warning(fmt.Sprintf(format, a...)))
 }
 func (s sysLogger) Infof(format string, a ...interface{}) error {
-	return s.send(s.Writer.Info(fmt.Sprintf(format, a...)))
+	return s.send(s.info.Info(fmt.Sprintf(format, a...)))
 }
 
 func run(command string, arguments ...string) error {
-	cmd := exec.Command(command, arguments...)
+	_, err := runCommand(command, arguments...)
+	return err
+}
 
-	// Connect pipe to read Stderr
-	stderr, err := cmd.StderrPipe()
+// runWithOutput runs command and returns its standard output.
+func runWithOutput(command string, arguments ...string) (string, error) {
+	return runCommand(command, arguments...)
+}
 
-	if err != nil {
-		// Failed to connect pipe
-		return fmt.Errorf("%q failed to connect stderr pipe: %v", command, err)
+// reloadSignals maps names accepted by the ReloadSignal option to signals.
+var reloadSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// reloadHandler returns the OnReload option, or Reload of the program if it
+// implements Reloader, or nil.
+func reloadHandler(s Service, c *Config, i Interface) func() error {
+	if f, ok := c.Option[optionOnReload].(func() error); ok {
+		return f
 	}
+	if r, ok := i.(Reloader); ok {
+		return func() error { return r.Reload(s) }
+	}
+	return nil
+}
 
-	// Do not use cmd.Run()
-	if err := cmd.Start(); err != nil {
-		// Problem while copying stdin, stdout, or stderr
-		return fmt.Errorf("%q failed: %v", command, err)
+// runWait blocks until one of stopSignals arrives and returns it. If a
+// reload handler is configured, SIGHUP and the ReloadSignal call it instead.
+// The RunWait option replaces all of this with a user function, and a false
+// ManageSignals with RunWait or StopChannel. It returns nil if no signal
+// stopped the service, and configChanged if a WatchConfig file changed.
+func runWait(s Service, c *Config, i Interface, stopSignals ...os.Signal) os.Signal {
+	if wait := c.Option.funcSingle(optionRunWait, nil); wait != nil {
+		wait()
+		return nil
+	}
+	if wait := c.unmanagedWait(); wait != nil {
+		wait()
+		return nil
 	}
 
-	// Zero exit status
-	// Darwin: launchctl can fail with a zero exit status,
-	// so check for emtpy stderr
-	if command == "launchctl" {
-		slurp, _ := ioutil.ReadAll(stderr)
-		if len(slurp) > 0 {
-			return fmt.Errorf("%q failed with stderr: %s", command, slurp)
+	var sigChan = make(chan os.Signal, 3)
+	signal.Notify(sigChan, stopSignals...)
+	defer signal.Stop(sigChan)
+
+	reload := reloadHandler(s, c, i)
+	isReload := map[os.Signal]bool{}
+	if reload != nil {
+		isReload[syscall.SIGHUP] = true
+		name := strings.TrimPrefix(c.Option.string(optionReloadSignal, ""), "SIG")
+		if sig, ok := reloadSignals[name]; ok {
+			isReload[sig] = true
+		}
+		for sig := range isReload {
+			signal.Notify(sigChan, sig)
 		}
+	} else if c.Option.bool(optionIgnoreHUP, false) {
+		signal.Ignore(syscall.SIGHUP)
 	}
 
-	if err := cmd.Wait(); err != nil {
-		// Command didn't exit with a zero exit status.
-		return fmt.Errorf("%q failed: %v", command, err)
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	changed := watchConfig(c.watchConfigPaths(), configPollInterval, stopWatch)
+
+	for {
+		select {
+		case sig := <-sigChan:
+			if !isReload[sig] {
+				return sig
+			}
+		case <-changed:
+			if reload == nil {
+				return configChanged
+			}
+		}
+		if err := reload(); err != nil {
+			if l, lerr := s.Logger(nil); lerr == nil {
+				l.Errorf("Reload failed: %v", err)
+			}
+		}
 	}
+}
 
-	return nil
+// configChanged is returned by runWait when a WatchConfig file changed and
+// there is no reload handler.
+var configChanged os.Signal = configChangeSignal{}
+
+type configChangeSignal struct{}
+
+func (configChangeSignal) String() string { return "configuration changed" }
+func (configChangeSignal) Signal()        {}
+
+// errConfigChanged makes a stop for a changed configuration a failure, so
+// service managers that only restart failed services, as with the default
+// of RestartOnCleanExit, still start the service with the new file.
+var errConfigChanged = errors.New("Configuration changed; exiting for the service manager to restart the service.")
+
+// reraise returns the error Run returns. That is errConfigChanged if the
+// program stopped without error for a changed configuration. Otherwise it
+// is err, and if the ReraiseSignal option is set and the service stopped
+// without error, reraise first sends sig to the process again with its
+// default action. It is deferred before redirectOutput, so captured output
+// is flushed first.
+func reraise(c *Config, sig os.Signal, err error) error {
+	if sig == configChanged && err == nil {
+		return errConfigChanged
+	}
+	if sig == nil || err != nil || !c.Option.bool(optionReraiseSignal, optionReraiseSignalDefault) {
+		return err
+	}
+	ssig, ok := sig.(syscall.Signal)
+	if !ok {
+		return err
+	}
+	signal.Reset(ssig)
+	if syscall.Kill(os.Getpid(), ssig) != nil {
+		return err
+	}
+	// The signal arrives asynchronously; wait rather than exit with 0 first.
+	time.Sleep(time.Second)
+	return err
+}
+
+// configPollInterval is how often WatchConfig files are checked.
+const configPollInterval = time.Second
+
+// watchConfigPaths returns the WatchConfig option as a list.
+func (c *Config) watchConfigPaths() []string {
+	if p := c.Option.string(optionWatchConfig, ""); len(p) != 0 {
+		return []string{p}
+	}
+	return c.Option.strings(optionWatchConfig, nil)
+}
+
+// fileStamp is what watchConfig compares to detect a change.
+type fileStamp struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func stat(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{true, fi.Size(), fi.ModTime()}
+}
+
+// watchConfig polls paths every interval until stop is closed. The returned
+// channel receives once per change, after the files are unchanged for one
+// interval, so a file written in several steps is reported once. It is nil,
+// and never receives, if there are no paths.
+func watchConfig(paths []string, interval time.Duration, stop <-chan struct{}) <-chan struct{} {
+	if len(paths) == 0 {
+		return nil
+	}
+	changed := make(chan struct{}, 1)
+	// Stat before returning, so changes made right after the call count.
+	last := make([]fileStamp, len(paths))
+	for i, p := range paths {
+		last[i] = stat(p)
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		pending := false
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+			moved := false
+			for i, p := range paths {
+				if st := stat(p); st != last[i] {
+					last[i] = st
+					moved = true
+				}
+			}
+			switch {
+			case moved:
+				pending = true
+			case pending:
+				pending = false
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed
+}
+
+// redirectStd points the standard output and error descriptors at stdout and
+// stderr, so everything written to them is redirected: os.Stdout, os.Stderr,
+// the log package and the runtime all write to descriptors 1 and 2. The
+// variables are not changed, so goroutines that are already writing are safe.
+func redirectStd(stdout, stderr *os.File) (restore func(), err error) {
+	var saved []int
+	restore = func() {
+		for fd, orig := range saved {
+			dupTo(orig, fd+1)
+			syscall.Close(orig)
+		}
+	}
+	for fd, f := range []*os.File{stdout, stderr} {
+		orig, err := syscall.Dup(fd + 1)
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		if err = dupTo(int(f.Fd()), fd+1); err != nil {
+			syscall.Close(orig)
+			restore()
+			return nil, err
+		}
+		saved = append(saved, orig)
+	}
+	return restore, nil
 }
@@ -7,9 +7,9 @@ package service
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
-	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
@@ -31,6 +31,35 @@ func isUpstart() bool {
 	return false
 }
 
+// upstartStatusAll reads the status of all jobs from one initctl list.
+// Its lines look like "name start/running, process 123".
+func upstartStatusAll(names []string) (map[string]Status, error) {
+	out, err := runWithOutput("initctl", "list")
+	if err != nil {
+		return nil, err
+	}
+	want := make(map[string]bool, len(names))
+	for _, name := range names {
+		want[name] = true
+	}
+	status := make(map[string]Status, len(names))
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !want[fields[0]] {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(fields[1], "start/running"):
+			status[fields[0]] = StatusRunning
+		case strings.HasPrefix(fields[1], "stop/waiting"):
+			status[fields[0]] = StatusStopped
+		default:
+			status[fields[0]] = StatusUnknown
+		}
+	}
+	return status, nil
+}
+
 type upstart struct {
 	i Interface
 	*Config
@@ -52,6 +81,10 @@ func (s *upstart) String() string {
 	return s.Name
 }
 
+func (s *upstart) program() Interface {
+	return s.i
+}
+
 // Upstart has some support for user services in graphical sessions.
 // Due to the mix of actual support for user services over versions, just don't bother.
 // Upstart will be replaced by systemd in most cases anyway.
@@ -69,13 +102,13 @@ func (s *upstart) configPath() (cp string, err error) {
 func (s *upstart) hasKillStanza() bool {
 	defaultValue := true
 
-	out, err := exec.Command("/sbin/init", "--version").Output()
+	out, err := runWithOutput("/sbin/init", "--version")
 	if err != nil {
 		return defaultValue
 	}
 
 	re := regexp.MustCompile(`init \(upstart (\d+.\d+.\d+)\)`)
-	matches := re.FindStringSubmatch(string(out))
+	matches := re.FindStringSubmatch(out)
 	if len(matches) != 2 {
 		return defaultValue
 	}
@@ -96,6 +129,9 @@ func (s *upstart) hasKillStanza() bool {
 	return defaultValue
 }
 
+// upstartDefaultKillTimeout is the default of the kill timeout stanza.
+const upstartDefaultKillTimeout = 5 * time.Second
+
 func versionAtMost(version, max []int) bool {
 	for idx, m := range max {
 		v := version[idx]
@@ -110,6 +146,20 @@ func (s *upstart) template() *template.Template {
 	return template.Must(template.New("").Funcs(tf).Parse(upstartScript))
 }
 
+// installedPath reads the executable from the pre-start test of the
+// installed job.
+func (s *upstart) installedPath() (string, error) {
+	cp, err := s.configPath()
+	if err != nil {
+		return "", err
+	}
+	line, err := readPrefixedLine(cp, "test -x ")
+	if err != nil {
+		return "", err
+	}
+	return shellUnquote(strings.TrimSuffix(line, " || { stop; exit 0; }")), nil
+}
+
 func (s *upstart) Install() error {
 	confPath, err := s.configPath()
 	if err != nil {
@@ -119,7 +169,11 @@ func (s *upstart) Install() error {
 	if err == nil {
 		return fmt.Errorf("Init already exists: %s", confPath)
 	}
+	if _, err = supplementaryGroups(s.Option); err != nil {
+		return err
+	}
 
+	s.progress("writing job file")
 	f, err := os.Create(confPath)
 	if err != nil {
 		return err
@@ -131,17 +185,104 @@ func (s *upstart) Install() error {
 		return err
 	}
 
+	return s.render(f, path, s.hasKillStanza())
+}
+
+// pid reads the process ID from initctl status, which prints
+// "<name> start/running, process 1234" while the job runs. It is 0 while
+// the job is stopped.
+func (s *upstart) pid() (int, error) {
+	out, err := runWithOutput("initctl", "status", s.Name)
+	if err != nil {
+		return 0, err
+	}
+	i := strings.LastIndex(out, "process ")
+	if i < 0 {
+		return 0, nil
+	}
+	fields := strings.Fields(out[i+len("process "):])
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	return strconv.Atoi(fields[0])
+}
+
+// transitioning reads the goal and state from initctl status; only
+// start/running and stop/waiting are settled.
+func (s *upstart) transitioning() (bool, error) {
+	out, err := runWithOutput("initctl", "status", s.Name)
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) < 2 {
+		return false, fmt.Errorf("Unexpected initctl status output %q.", out)
+	}
+	switch strings.TrimSuffix(fields[1], ",") {
+	case "start/running", "stop/waiting":
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *upstart) listeningPorts() ([]string, error) {
+	pid, err := s.pid()
+	if err != nil || pid == 0 {
+		return nil, err
+	}
+	return procListening(pid)
+}
+
+func (s *upstart) resourceUsage() (ResourceUsage, error) {
+	pid, err := s.pid()
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	if pid == 0 {
+		return ResourceUsage{}, fmt.Errorf("%s is not running.", s.Name)
+	}
+	return procUsage(pid)
+}
+
+func (s *upstart) startedAt() (time.Time, error) {
+	pid, err := s.pid()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if pid == 0 {
+		return time.Time{}, fmt.Errorf("%s is not running.", s.Name)
+	}
+	return procStartTime(pid)
+}
+
+// launchedByManager checks UPSTART_JOB, which upstart sets to the job name.
+func (s *upstart) launchedByManager() bool {
+	return os.Getenv("UPSTART_JOB") == s.Name
+}
+
+func (s *upstart) render(w io.Writer, path string, hasKillStanza bool) error {
+	// setpriv switches to UserName itself, as it needs root to set the groups.
+	setpriv, err := setprivPrefix(s.Option, s.UserName)
+	if err != nil {
+		return err
+	}
 	var to = &struct {
 		*Config
 		Path          string
 		HasKillStanza bool
+		KillTimeout   int
+		Setpriv       string
+		NormalExit    bool
 	}{
 		s.Config,
 		path,
-		s.hasKillStanza(),
+		hasKillStanza,
+		seconds(s.timeout(optionStopTimeout, 0)),
+		setpriv,
+		!s.Option.bool(optionRestartOnCleanExit, optionRestartOnCleanExitDefault),
 	}
 
-	return s.template().Execute(f, to)
+	return s.template().Execute(w, to)
 }
 
 func (s *upstart) Uninstall() error {
@@ -162,21 +303,34 @@ func (s *upstart) Logger(errs chan<- error) (Logger, error) {
 	return s.SystemLogger(errs)
 }
 func (s *upstart) SystemLogger(errs chan<- error) (Logger, error) {
-	return newSysLogger(s.Name, errs)
+	return newSysLogger(s.Name, s.Option, errs)
 }
 
 func (s *upstart) Run() (err error) {
+	var sig os.Signal
+	defer func() { err = reraise(s.Config, sig, err) }()
+	defer redirectOutput(s, s.Config)()
+	states := s.states()
+	defer states.set(StateStopped)
+
+	if err = setIOScheduling(s.Option); err != nil {
+		return err
+	}
+	if err = joinCGroup(cgroupRoot, s.Name, s.Option); err != nil {
+		return err
+	}
+
+	states.set(StateStarting)
 	err = s.i.Start(s)
 	if err != nil {
 		return err
 	}
+	states.set(StateRunning)
 
-	s.Option.funcSingle(optionRunWait, func() {
-		var sigChan = make(chan os.Signal, 3)
-		signal.Notify(sigChan, os.Interrupt, os.Kill)
-		<-sigChan
-	})()
+	sig = runWait(s, s.Config, s.i, os.Interrupt, os.Kill)
+	states.set(StateStopping)
 
+	drain(s, s.i, s.timeout(optionStopTimeout, upstartDefaultKillTimeout))
 	return s.i.Stop(s)
 }
 
@@ -197,6 +351,25 @@ func (s *upstart) Restart() error {
 	return s.Start()
 }
 
+// initctlVerbs lists the initctl verbs Exec runs. They all act on the job
+// named after them, so the ones that act on the whole system, such as emit
+// or log-priority, can never be reached through Exec.
+var initctlVerbs = map[string]bool{
+	"start":       true,
+	"stop":        true,
+	"restart":     true,
+	"reload":      true,
+	"status":      true,
+	"show-config": true,
+}
+
+func (s *upstart) exec(args ...string) (string, error) {
+	if !initctlVerbs[args[0]] {
+		return "", fmt.Errorf("Refusing to run %q, which is not an initctl job command.", args[0])
+	}
+	return runCombined("initctl", append([]string{args[0], s.Name}, args[1:]...)...)
+}
+
 // The upstart script should stop with an INT or the Go runtime will terminate
 // the program before the Stop handler can run.
 const upstartScript = `# {{.Description}}
@@ -204,23 +377,25 @@ const upstartScript = `# {{.Description}}
 {{if .DisplayName}}description    "{{.DisplayName}}"{{end}}
 
 {{if .HasKillStanza}}kill signal INT{{end}}
+{{if .KillTimeout}}kill timeout {{.KillTimeout}}{{end}}
 {{if .ChRoot}}chroot {{.ChRoot}}{{end}}
 {{if .WorkingDirectory}}chdir {{.WorkingDirectory}}{{end}}
 start on filesystem or runlevel [2345]
 stop on runlevel [!2345]
 
-{{if .UserName}}setuid {{.UserName}}{{end}}
+{{if and .UserName (not .Setpriv)}}setuid {{.UserName}}{{end}}
 
 respawn
 respawn limit 10 5
+{{if .NormalExit}}normal exit 0 TERM INT{{end}}
 umask 022
 
 console none
 
 pre-start script
-    test -x {{.Path}} || { stop; exit 0; }
+    test -x {{.Path|shellQuote}} || { stop; exit 0; }
 end script
 
 # Start
-exec {{.Path}}{{range .Arguments}} {{.|cmd}}{{end}}
+exec {{.Setpriv}}{{.Path|shellQuote}}{{range .Arguments}} {{.|shellQuote}}{{end}}
 `
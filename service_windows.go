@@ -5,13 +5,20 @@
 package service
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
+	"unsafe"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/eventlog"
@@ -26,6 +33,9 @@ type windowsService struct {
 
 	errSync      sync.Mutex
 	stopStartErr error
+
+	mSync sync.Mutex
+	m     *mgr.Mgr
 }
 
 // WindowsLogger allows using windows specific logging methods.
@@ -53,6 +63,106 @@ func (windowsSystem) New(i Interface, c *Config) (Service, error) {
 	return ws, nil
 }
 
+// statusAll reads the status of all services with one EnumServicesStatusEx call.
+func (windowsSystem) statusAll(names []string) (map[string]Status, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer m.Disconnect()
+
+	var bytesNeeded, servicesReturned uint32
+	var buf []byte
+	for {
+		var p *byte
+		if len(buf) > 0 {
+			p = &buf[0]
+		}
+		err = windows.EnumServicesStatusEx(m.Handle, windows.SC_ENUM_PROCESS_INFO,
+			windows.SERVICE_WIN32, windows.SERVICE_STATE_ALL,
+			p, uint32(len(buf)), &bytesNeeded, &servicesReturned, nil, nil)
+		if err == nil {
+			break
+		}
+		if err != syscall.ERROR_MORE_DATA || bytesNeeded <= uint32(len(buf)) {
+			return nil, err
+		}
+		buf = make([]byte, bytesNeeded)
+	}
+
+	// Service names are not case sensitive.
+	want := make(map[string]string, len(names))
+	for _, name := range names {
+		want[strings.ToLower(name)] = name
+	}
+	status := make(map[string]Status, len(names))
+	if servicesReturned == 0 {
+		return status, nil
+	}
+	services := (*[1 << 20]windows.ENUM_SERVICE_STATUS_PROCESS)(unsafe.Pointer(&buf[0]))[:servicesReturned:servicesReturned]
+	for _, s := range services {
+		name, ok := want[strings.ToLower(windows.UTF16PtrToString(s.ServiceName))]
+		if !ok {
+			continue
+		}
+		switch s.ServiceStatusProcess.CurrentState {
+		case windows.SERVICE_RUNNING:
+			status[name] = StatusRunning
+		case windows.SERVICE_STOPPED:
+			status[name] = StatusStopped
+		default:
+			status[name] = StatusUnknown
+		}
+	}
+	return status, nil
+}
+
+// instances finds the services whose description marks them as instances
+// of base.
+func (windowsSystem) instances(base string) ([]string, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer m.Disconnect()
+	all, err := m.ListServices()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range all {
+		if !strings.HasPrefix(strings.ToLower(name), strings.ToLower(base)+"-") {
+			continue
+		}
+		s, err := m.OpenService(name)
+		if err != nil {
+			continue
+		}
+		c, err := s.Config()
+		s.Close()
+		if err == nil && hasDescriptionExtra(c.Description, instanceMarker, base) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// hasDescriptionExtra reports whether the description extra entries that
+// description ends with, "[key: value; ...]", hold key with value.
+func hasDescriptionExtra(description, key, value string) bool {
+	i := strings.LastIndex(description, " [")
+	if i < 0 || !strings.HasSuffix(description, "]") {
+		return false
+	}
+	want := extraEntry{key, value}.String()
+	for _, e := range strings.Split(description[i+2:len(description)-1], "; ") {
+		if e == want {
+			return true
+		}
+	}
+	return false
+}
+
 func init() {
 	ChooseSystem(windowsSystem{})
 }
@@ -144,6 +254,44 @@ func (ws *windowsService) String() string {
 	return ws.Name
 }
 
+func (ws *windowsService) program() Interface {
+	return ws.i
+}
+
+// manager connects to the service control manager. The returned function
+// disconnects, unless KeepManagerConnection keeps the connection until Close.
+func (ws *windowsService) manager() (*mgr.Mgr, func(), error) {
+	if !ws.Option.bool(optionKeepManagerConnection, optionKeepManagerConnectionDefault) {
+		m, err := mgr.Connect()
+		if err != nil {
+			return nil, nil, err
+		}
+		return m, func() { m.Disconnect() }, nil
+	}
+	ws.mSync.Lock()
+	defer ws.mSync.Unlock()
+	if ws.m == nil {
+		m, err := mgr.Connect()
+		if err != nil {
+			return nil, nil, err
+		}
+		ws.m = m
+	}
+	return ws.m, func() {}, nil
+}
+
+// Close disconnects a connection kept by KeepManagerConnection.
+func (ws *windowsService) Close() error {
+	ws.mSync.Lock()
+	defer ws.mSync.Unlock()
+	if ws.m == nil {
+		return nil
+	}
+	err := ws.m.Disconnect()
+	ws.m = nil
+	return err
+}
+
 func (ws *windowsService) setError(err error) {
 	ws.errSync.Lock()
 	defer ws.errSync.Unlock()
@@ -157,13 +305,30 @@ func (ws *windowsService) getError() error {
 
 func (ws *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
 	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
-	changes <- svc.Status{State: svc.StartPending}
+	states := ws.states()
+	defer states.set(StateStopped)
+	states.set(StateStarting)
+	changes <- svc.Status{State: svc.StartPending, WaitHint: uint32(ws.Option.duration(optionTimeout, 0) / time.Millisecond)}
 
 	if err := ws.i.Start(ws); err != nil {
 		ws.setError(err)
 		return true, 1
 	}
+	if err := ws.waitReady(r, changes); err == errStopWhileStarting {
+		states.set(StateStopping)
+		changes <- svc.Status{State: svc.StopPending, WaitHint: uint32(ws.stopTimeout() / time.Millisecond)}
+		if err = ws.i.Stop(ws); err != nil {
+			ws.setError(err)
+			return true, 2
+		}
+		return false, 0
+	} else if err != nil {
+		ws.i.Stop(ws)
+		ws.setError(err)
+		return true, 3
+	}
 
+	states.set(StateRunning)
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 loop:
 	for {
@@ -172,7 +337,10 @@ loop:
 		case svc.Interrogate:
 			changes <- c.CurrentStatus
 		case svc.Stop, svc.Shutdown:
-			changes <- svc.Status{State: svc.StopPending}
+			timeout := ws.stopTimeout()
+			states.set(StateStopping)
+			changes <- svc.Status{State: svc.StopPending, WaitHint: uint32(timeout / time.Millisecond)}
+			drain(ws, ws.i, timeout)
 			if err := ws.i.Stop(ws); err != nil {
 				ws.setError(err)
 				return true, 2
@@ -186,34 +354,140 @@ loop:
 	return false, 0
 }
 
+// readinessInterval is the time between ReadinessProbe calls.
+const readinessInterval = time.Second
+
+// errStopWhileStarting is returned by waitReady when the service manager
+// asks the service to stop before it is ready.
+var errStopWhileStarting = errors.New("Stop requested before the service was ready.")
+
+// waitReady calls the ReadinessProbe option until it succeeds, reporting
+// start pending with a new checkpoint after each failure so the service
+// manager knows the service is making progress. It gives up after Timeout,
+// or the stop timeout if Timeout is not set, and ends early on a stop request.
+func (ws *windowsService) waitReady(r <-chan svc.ChangeRequest, changes chan<- svc.Status) error {
+	probe, ok := ws.Option[optionReadinessProbe].(func() error)
+	if !ok {
+		return nil
+	}
+	timeout := ws.Option.duration(optionTimeout, 0)
+	if timeout <= 0 {
+		timeout = ws.stopTimeout()
+	}
+	deadline := time.Now().Add(timeout)
+	for checkpoint := uint32(1); ; checkpoint++ {
+		err := probe()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service not ready: %v", err)
+		}
+		status := svc.Status{State: svc.StartPending, CheckPoint: checkpoint, WaitHint: uint32(2 * readinessInterval / time.Millisecond)}
+		changes <- status
+		wait := time.NewTimer(readinessInterval)
+	sleep:
+		for {
+			select {
+			case <-wait.C:
+				break sleep
+			case c := <-r:
+				switch c.Cmd {
+				case svc.Interrogate:
+					changes <- status
+				case svc.Stop, svc.Shutdown:
+					wait.Stop()
+					return errStopWhileStarting
+				}
+			}
+		}
+	}
+}
+
+// maxDescription is the longest service description Windows accepts.
+const maxDescription = 1024
+
+// description returns Description followed by any DescriptionExtra entries.
+// Description is truncated to what Windows accepts, so the entries, which
+// mark the instances of InstallInstances, are always kept.
+func (ws *windowsService) description() (string, error) {
+	d, extra := ws.Description, ""
+	if entries := ws.descriptionExtra(); len(entries) > 0 {
+		parts := make([]string, len(entries))
+		for i, e := range entries {
+			parts[i] = e.String()
+		}
+		extra = " [" + strings.Join(parts, "; ") + "]"
+	}
+	limit := maxDescription - utf8.RuneCountInString(extra)
+	if limit < 0 {
+		return "", fmt.Errorf("%s does not fit in the %d characters of a Windows description.", optionDescriptionExtra, maxDescription)
+	}
+	if r := []rune(d); len(r) > limit {
+		if limit < len("...") {
+			d = ""
+		} else {
+			d = string(r[:limit-len("...")]) + "..."
+		}
+	}
+	return d + extra, nil
+}
+
 func (ws *windowsService) Install() error {
 	exepath, err := ws.execPath()
 	if err != nil {
 		return err
 	}
 
-	m, err := mgr.Connect()
+	m, disconnect, err := ws.manager()
 	if err != nil {
 		return err
 	}
-	defer m.Disconnect()
+	defer disconnect()
 	s, err := m.OpenService(ws.Name)
 	if err == nil {
 		s.Close()
 		return fmt.Errorf("service %s already exists", ws.Name)
 	}
+	startName, password, err := ws.account()
+	if err != nil {
+		return err
+	}
+	restart, err := ws.restart("")
+	if err != nil {
+		return err
+	}
+	description, err := ws.description()
+	if err != nil {
+		return err
+	}
+	ws.progress("creating service")
+	// CreateService quotes exepath and each argument with syscall.EscapeArg,
+	// so paths containing spaces are safe.
 	s, err = m.CreateService(ws.Name, exepath, mgr.Config{
 		DisplayName:      ws.DisplayName,
-		Description:      ws.Description,
+		Description:      description,
 		StartType:        mgr.StartAutomatic,
-		ServiceStartName: ws.UserName,
-		Password:         ws.Option.string("Password", ""),
+		ServiceStartName: startName,
+		Password:         password,
 		Dependencies:     ws.Dependencies,
 	}, ws.Arguments...)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
+	if actions, nonCrash := recoveryActions(restart); len(actions) != 0 {
+		ws.progress("setting recovery actions")
+		if err = s.SetRecoveryActions(actions, recoveryResetPeriod); err != nil {
+			s.Delete()
+			return err
+		}
+		if err = s.SetRecoveryActionsOnNonCrashFailures(nonCrash); err != nil {
+			s.Delete()
+			return err
+		}
+	}
+	ws.progress("registering event source")
 	err = eventlog.InstallAsEventCreate(ws.Name, eventlog.Error|eventlog.Warning|eventlog.Info)
 	if err != nil {
 		s.Delete()
@@ -222,17 +496,111 @@ func (ws *windowsService) Install() error {
 	return nil
 }
 
+const (
+	// recoveryDelay matches RestartSec of systemd units.
+	recoveryDelay = 120 * time.Second
+	// recoveryResetPeriod is how long, in seconds, the service must run
+	// before its failure count is reset.
+	recoveryResetPeriod = 24 * 60 * 60
+)
+
+// recoveryActions maps the Restart option to recovery actions, and whether
+// they also apply when the service stops with a non-zero exit code. Windows
+// never restarts a service that stopped cleanly, so on-success is no.
+func recoveryActions(restart string) ([]mgr.RecoveryAction, bool) {
+	switch restart {
+	case "", "no", "on-success":
+		return nil, false
+	}
+	// One action each for the first, second and subsequent failures.
+	action := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: recoveryDelay}
+	actions := []mgr.RecoveryAction{action, action, action}
+	return actions, restart == "always" || restart == "on-failure"
+}
+
+// virtualAccountPrefix is the domain of service virtual accounts.
+const virtualAccountPrefix = `NT SERVICE\`
+
+// account returns the account the service runs as and its password.
+// Virtual accounts have no password; the service manager creates them
+// along with the service and grants them the right to log on as a service.
+func (ws *windowsService) account() (startName, password string, err error) {
+	startName = ws.UserName
+	password = ws.Option.string(optionPassword, "")
+	if ws.Option.bool(optionVirtualAccount, optionVirtualAccountDefault) {
+		if len(startName) != 0 && !strings.EqualFold(startName, virtualAccountPrefix+ws.Name) {
+			return "", "", fmt.Errorf("%s runs as %s%s, not UserName %s.", optionVirtualAccount, virtualAccountPrefix, ws.Name, startName)
+		}
+		startName = virtualAccountPrefix + ws.Name
+	}
+	if len(startName) > len(virtualAccountPrefix) && strings.EqualFold(startName[:len(virtualAccountPrefix)], virtualAccountPrefix) {
+		if len(password) != 0 {
+			return "", "", fmt.Errorf("virtual account %s has no password.", startName)
+		}
+	}
+	return startName, password, nil
+}
+
+// installedPath reads the executable from the binary path of the
+// installed service, which starts with the executable, quoted if needed.
+func (ws *windowsService) installedPath() (string, error) {
+	m, disconnect, err := ws.manager()
+	if err != nil {
+		return "", err
+	}
+	defer disconnect()
+	s, err := m.OpenService(ws.Name)
+	if err != nil {
+		return "", fmt.Errorf("service %s is not installed", ws.Name)
+	}
+	defer s.Close()
+	c, err := s.Config()
+	if err != nil {
+		return "", err
+	}
+	args, err := splitBinaryPathName(c.BinaryPathName)
+	if err != nil {
+		return "", err
+	}
+	return args[0], nil
+}
+
+// splitBinaryPathName splits the binary path of a service into the
+// executable and its arguments. CreateService joins them with
+// syscall.EscapeArg, so they are split with the rules of CommandLineToArgvW.
+func splitBinaryPathName(bin string) ([]string, error) {
+	args, err := windows.DecomposeCommandLine(bin)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("service binary path is empty")
+	}
+	return args, nil
+}
+
 func (ws *windowsService) Uninstall() error {
-	m, err := mgr.Connect()
+	m, disconnect, err := ws.manager()
 	if err != nil {
 		return err
 	}
-	defer m.Disconnect()
+	defer disconnect()
 	s, err := m.OpenService(ws.Name)
 	if err != nil {
 		return fmt.Errorf("service %s is not installed", ws.Name)
 	}
 	defer s.Close()
+	if ws.Option.bool(optionStopOnUninstall, optionStopOnUninstallDefault) {
+		// A deleted service that is still running is only removed once it
+		// stops, so stop it first.
+		status, err := s.Query()
+		if err == nil && status.State != svc.Stopped {
+			ws.progress("stopping")
+			if err = ws.stopWait(s); err != nil {
+				return err
+			}
+		}
+	}
 	err = s.Delete()
 	if err != nil {
 		return err
@@ -244,8 +612,36 @@ func (ws *windowsService) Uninstall() error {
 	return nil
 }
 
+// redirectStd points the standard output and error handles of the process,
+// which the runtime writes panics to, at stdout and stderr, and swaps them
+// into os.Stdout, os.Stderr and, unless it was changed, the log package.
+// Writes already in progress on other goroutines race with the swap.
+func redirectStd(stdout, stderr *os.File) (restore func(), err error) {
+	origOut, origErr, origLog := os.Stdout, os.Stderr, log.Writer()
+	if err = windows.SetStdHandle(windows.STD_OUTPUT_HANDLE, windows.Handle(stdout.Fd())); err != nil {
+		return nil, err
+	}
+	if err = windows.SetStdHandle(windows.STD_ERROR_HANDLE, windows.Handle(stderr.Fd())); err != nil {
+		windows.SetStdHandle(windows.STD_OUTPUT_HANDLE, windows.Handle(origOut.Fd()))
+		return nil, err
+	}
+	os.Stdout, os.Stderr = stdout, stderr
+	if origLog == origErr {
+		log.SetOutput(stderr)
+	}
+	return func() {
+		if origLog == origErr {
+			log.SetOutput(origErr)
+		}
+		os.Stdout, os.Stderr = origOut, origErr
+		windows.SetStdHandle(windows.STD_OUTPUT_HANDLE, windows.Handle(origOut.Fd()))
+		windows.SetStdHandle(windows.STD_ERROR_HANDLE, windows.Handle(origErr.Fd()))
+	}, nil
+}
+
 func (ws *windowsService) Run() error {
 	ws.setError(nil)
+	defer redirectOutput(ws, ws.Config)()
 	if !interactive {
 		// Return error messages from start and stop routines
 		// that get executed in the Execute method.
@@ -261,26 +657,36 @@ func (ws *windowsService) Run() error {
 		}
 		return nil
 	}
+	states := ws.states()
+	defer states.set(StateStopped)
+	states.set(StateStarting)
 	err := ws.i.Start(ws)
 	if err != nil {
 		return err
 	}
+	states.set(StateRunning)
 
-	sigChan := make(chan os.Signal)
+	if wait := ws.unmanagedWait(); wait != nil {
+		wait()
+	} else {
+		sigChan := make(chan os.Signal)
 
-	signal.Notify(sigChan, os.Interrupt, os.Kill)
+		signal.Notify(sigChan, os.Interrupt, os.Kill)
 
-	<-sigChan
+		<-sigChan
+	}
 
+	states.set(StateStopping)
+	drain(ws, ws.i, ws.stopTimeout())
 	return ws.i.Stop(ws)
 }
 
 func (ws *windowsService) Start() error {
-	m, err := mgr.Connect()
+	m, disconnect, err := ws.manager()
 	if err != nil {
 		return err
 	}
-	defer m.Disconnect()
+	defer disconnect()
 
 	s, err := m.OpenService(ws.Name)
 	if err != nil {
@@ -291,11 +697,11 @@ func (ws *windowsService) Start() error {
 }
 
 func (ws *windowsService) Stop() error {
-	m, err := mgr.Connect()
+	m, disconnect, err := ws.manager()
 	if err != nil {
 		return err
 	}
-	defer m.Disconnect()
+	defer disconnect()
 
 	s, err := m.OpenService(ws.Name)
 	if err != nil {
@@ -307,11 +713,11 @@ func (ws *windowsService) Stop() error {
 }
 
 func (ws *windowsService) Restart() error {
-	m, err := mgr.Connect()
+	m, disconnect, err := ws.manager()
 	if err != nil {
 		return err
 	}
-	defer m.Disconnect()
+	defer disconnect()
 
 	s, err := m.OpenService(ws.Name)
 	if err != nil {
@@ -327,6 +733,113 @@ func (ws *windowsService) Restart() error {
 	return s.Start()
 }
 
+// processMemoryCounters is PROCESS_MEMORY_COUNTERS.
+type processMemoryCounters struct {
+	cb                         uint32
+	PageFaultCount             uint32
+	PeakWorkingSetSize         uintptr
+	WorkingSetSize             uintptr
+	QuotaPeakPagedPoolUsage    uintptr
+	QuotaPagedPoolUsage        uintptr
+	QuotaPeakNonPagedPoolUsage uintptr
+	QuotaNonPagedPoolUsage     uintptr
+	PagefileUsage              uintptr
+	PeakPagefileUsage          uintptr
+}
+
+var procGetProcessMemoryInfo = windows.NewLazySystemDLL("kernel32.dll").NewProc("K32GetProcessMemoryInfo")
+
+// transitioning checks for one of the pending states.
+func (ws *windowsService) transitioning() (bool, error) {
+	m, disconnect, err := ws.manager()
+	if err != nil {
+		return false, err
+	}
+	defer disconnect()
+	s, err := m.OpenService(ws.Name)
+	if err != nil {
+		return false, err
+	}
+	defer s.Close()
+	status, err := s.Query()
+	if err != nil {
+		return false, err
+	}
+	switch status.State {
+	case svc.StartPending, svc.StopPending, svc.ContinuePending, svc.PausePending:
+		return true, nil
+	}
+	return false, nil
+}
+
+// openProcess opens the process of the running service for queries.
+func (ws *windowsService) openProcess() (windows.Handle, error) {
+	m, disconnect, err := ws.manager()
+	if err != nil {
+		return 0, err
+	}
+	defer disconnect()
+	s, err := m.OpenService(ws.Name)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	status, err := s.Query()
+	if err != nil {
+		return 0, err
+	}
+	if status.ProcessId == 0 {
+		return 0, fmt.Errorf("%s is not running.", ws.Name)
+	}
+	return windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, status.ProcessId)
+}
+
+// resourceUsage reads the working set and the kernel and user time of the
+// service process.
+func (ws *windowsService) resourceUsage() (ResourceUsage, error) {
+	var u ResourceUsage
+	h, err := ws.openProcess()
+	if err != nil {
+		return u, err
+	}
+	defer windows.CloseHandle(h)
+
+	var creation, exit, kernel, user windows.Filetime
+	if err = windows.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return u, err
+	}
+	u.CPU = filetimeDuration(kernel) + filetimeDuration(user)
+
+	var mc processMemoryCounters
+	mc.cb = uint32(unsafe.Sizeof(mc))
+	if r, _, err := procGetProcessMemoryInfo.Call(uintptr(h), uintptr(unsafe.Pointer(&mc)), uintptr(mc.cb)); r == 0 {
+		return u, err
+	}
+	u.Memory = uint64(mc.WorkingSetSize)
+	return u, nil
+}
+
+// startedAt reads the creation time of the service process.
+func (ws *windowsService) startedAt() (time.Time, error) {
+	h, err := ws.openProcess()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer windows.CloseHandle(h)
+
+	var creation, exit, kernel, user windows.Filetime
+	if err = windows.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, creation.Nanoseconds()), nil
+}
+
+// filetimeDuration converts a Filetime holding a duration, counted in
+// 100 nanosecond intervals, unlike Filetime.Nanoseconds, which expects a date.
+func filetimeDuration(ft windows.Filetime) time.Duration {
+	return time.Duration(int64(ft.HighDateTime)<<32+int64(ft.LowDateTime)) * 100
+}
+
 func (ws *windowsService) stopWait(s *mgr.Service) error {
 	// First stop the service. Then wait for the service to
 	// actually stop before starting it.
@@ -337,7 +850,8 @@ func (ws *windowsService) stopWait(s *mgr.Service) error {
 
 	timeDuration := time.Millisecond * 50
 
-	timeout := time.After(getStopTimeout() + (timeDuration * 2))
+	stopTimeout := ws.stopTimeout()
+	timeout := time.After(stopTimeout + (timeDuration * 2))
 	tick := time.NewTicker(timeDuration)
 	defer tick.Stop()
 
@@ -349,12 +863,18 @@ func (ws *windowsService) stopWait(s *mgr.Service) error {
 				return err
 			}
 		case <-timeout:
-			break
+			return fmt.Errorf("Service %s did not stop within %v.", ws.Name, stopTimeout)
 		}
 	}
 	return nil
 }
 
+// stopTimeout returns the StopTimeout option, or how long Windows waits
+// for services to stop.
+func (ws *windowsService) stopTimeout() time.Duration {
+	return ws.timeout(optionStopTimeout, getStopTimeout())
+}
+
 // getStopTimeout fetches the time before windows will kill the service.
 func getStopTimeout() time.Duration {
 	// For default and paths see https://support.microsoft.com/en-us/kb/146092
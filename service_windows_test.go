@@ -5,10 +5,149 @@
 package service
 
 import (
+	"errors"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
 )
 
 func TestTimeout(t *testing.T) {
 	stopSpan := getStopTimeout()
 	t.Log("Max Stop Duration", stopSpan)
 }
+
+func TestVirtualAccount(t *testing.T) {
+	ws := &windowsService{Config: &Config{Name: "myd", Option: KeyValue{optionVirtualAccount: true}}}
+	name, password, err := ws.account()
+	if err != nil || name != `NT SERVICE\myd` || password != "" {
+		t.Errorf("account() = %q, %q, %v", name, password, err)
+	}
+
+	ws.Config = &Config{Name: "myd", UserName: `NT SERVICE\myd`, Option: KeyValue{optionPassword: "secret"}}
+	if _, _, err := ws.account(); err == nil {
+		t.Error("password accepted for a virtual account")
+	}
+}
+
+func TestSplitBinaryPathName(t *testing.T) {
+	for _, args := range [][]string{
+		{`C:\Program Files\My App\myd.exe`},
+		{`C:\Program Files\My App\myd.exe`, "-config", `C:\My Data\myd.conf`},
+		{`C:\myd.exe`, `say "hi"`, `trailing\`, `C:\dir with space\`, ""},
+	} {
+		// Built the way mgr.CreateService builds lpBinaryPathName.
+		bin := syscall.EscapeArg(args[0])
+		for _, a := range args[1:] {
+			bin += " " + syscall.EscapeArg(a)
+		}
+		got, err := splitBinaryPathName(bin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, args) {
+			t.Errorf("splitBinaryPathName(%s) = %q, want %q", bin, got, args)
+		}
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	tries := 0
+	ws := &windowsService{Config: &Config{Name: "myd", Option: KeyValue{
+		optionReadinessProbe: func() error {
+			if tries++; tries < 3 {
+				return errors.New("not yet")
+			}
+			return nil
+		},
+	}}}
+	changes := make(chan svc.Status, 10)
+	if err := ws.waitReady(nil, changes); err != nil {
+		t.Fatal(err)
+	}
+	close(changes)
+	var checkpoints []uint32
+	for c := range changes {
+		if c.State != svc.StartPending {
+			t.Errorf("state = %v, want StartPending", c.State)
+		}
+		checkpoints = append(checkpoints, c.CheckPoint)
+	}
+	if !reflect.DeepEqual(checkpoints, []uint32{1, 2}) {
+		t.Errorf("checkpoints = %v, want [1 2]", checkpoints)
+	}
+}
+
+func TestWaitReadyStop(t *testing.T) {
+	ws := &windowsService{Config: &Config{Name: "myd", Option: KeyValue{
+		optionReadinessProbe: func() error { return errors.New("not yet") },
+	}}}
+	r := make(chan svc.ChangeRequest, 1)
+	r <- svc.ChangeRequest{Cmd: svc.Stop}
+	changes := make(chan svc.Status, 10)
+	if err := ws.waitReady(r, changes); err != errStopWhileStarting {
+		t.Errorf("waitReady = %v, want %v", err, errStopWhileStarting)
+	}
+
+	ws.Option[optionTimeout] = time.Millisecond
+	if err := ws.waitReady(nil, changes); err == nil || err == errStopWhileStarting {
+		t.Errorf("waitReady past Timeout = %v", err)
+	}
+}
+
+func TestCloseUnconnected(t *testing.T) {
+	ws := &windowsService{Config: &Config{Name: "myd"}}
+	if err := Close(ws); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoveryActions(t *testing.T) {
+	for restart, want := range map[string]struct {
+		actions  int
+		nonCrash bool
+	}{
+		"":            {0, false},
+		"no":          {0, false},
+		"on-success":  {0, false},
+		"on-abnormal": {3, false},
+		"on-failure":  {3, true},
+		"always":      {3, true},
+	} {
+		actions, nonCrash := recoveryActions(restart)
+		if len(actions) != want.actions || nonCrash != want.nonCrash {
+			t.Errorf("recoveryActions(%q) = %d actions, %v", restart, len(actions), nonCrash)
+		}
+	}
+}
+
+func TestInstanceConfig(t *testing.T) {
+	base := &Config{Name: "myd", DisplayName: "My D", Arguments: []string{"-a"}, Option: KeyValue{
+		optionDescriptionExtra: map[string]string{"Contact": "ops@example.com"},
+	}}
+	c := instanceConfig(base, "web", []string{"-port", "80"})
+	if c.Name != "myd-web" || c.DisplayName != "My D (web)" || len(c.Arguments) != 2 {
+		t.Errorf("instanceConfig() = %+v", c)
+	}
+	ws := &windowsService{Config: c}
+	if d, err := ws.description(); err != nil || !hasDescriptionExtra(d, instanceMarker, "myd") {
+		t.Errorf("description %q, %v not marked as instance of myd", d, err)
+	}
+	if d, _ := ws.description(); hasDescriptionExtra(d, instanceMarker, "my") {
+		t.Errorf("description %q marked as instance of my", d)
+	}
+	c.Description = strings.Repeat("long ", maxDescription)
+	if d, err := ws.description(); err != nil || !hasDescriptionExtra(d, instanceMarker, "myd") || len([]rune(d)) > maxDescription {
+		t.Errorf("long description %q, %v lost the instance marker", d, err)
+	}
+	c.Option[optionDescriptionExtra] = map[string]string{"Contact": strings.Repeat("x", maxDescription)}
+	if _, err := ws.description(); err == nil {
+		t.Error("DescriptionExtra longer than a description accepted")
+	}
+	if len(base.Option[optionDescriptionExtra].(map[string]string)) != 1 {
+		t.Error("instanceConfig changed the base DescriptionExtra")
+	}
+}
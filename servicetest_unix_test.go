@@ -8,7 +8,11 @@ package service_test
 
 import (
 	"os"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/kardianos/service"
 )
 
 func interruptProcess(t *testing.T) {
@@ -21,3 +25,41 @@ func interruptProcess(t *testing.T) {
 		t.Fatalf("Signal: %s", err)
 	}
 }
+
+type reloadProgram struct {
+	program
+	reloaded chan struct{}
+}
+
+func (p *reloadProgram) Reload(s service.Service) error {
+	p.reloaded <- struct{}{}
+	return nil
+}
+
+func TestRunReload(t *testing.T) {
+	p := &reloadProgram{reloaded: make(chan struct{}, 1)}
+	s, err := service.New(p, &service.Config{Name: "go_service_test"})
+	if err != nil {
+		t.Fatalf("New err: %s", err)
+	}
+
+	go func() {
+		<-time.After(500 * time.Millisecond)
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Errorf("Kill: %s", err)
+		}
+		select {
+		case <-p.reloaded:
+		case <-time.After(5 * time.Second):
+			t.Error("Reload() was not called")
+		}
+		interruptProcess(t)
+	}()
+
+	if err = s.Run(); err != nil {
+		t.Fatalf("Run() err: %s", err)
+	}
+	if p.numStopped != 1 {
+		t.Errorf("numStopped = %d, want 1", p.numStopped)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2015 Daniel Theophanes.
+// Use of this source code is governed by a zlib-style
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	typeBool        = reflect.TypeOf(false)
+	typeInt         = reflect.TypeOf(0)
+	typeString      = reflect.TypeOf("")
+	typeStrings     = reflect.TypeOf([]string(nil))
+	typeDuration    = reflect.TypeOf(time.Duration(0))
+	typeFileMode    = reflect.TypeOf(os.FileMode(0))
+	typeStringMap   = reflect.TypeOf(map[string]string(nil))
+	typeIntMap      = reflect.TypeOf(map[string]int(nil))
+	typeIntMaps     = reflect.TypeOf([]map[string]int(nil))
+	typeFunc        = reflect.TypeOf(func() {})
+	typeErrorFunc   = reflect.TypeOf(func() error { return nil })
+	typeProgress    = reflect.TypeOf(func(step string) {})
+	typeStateChange = reflect.TypeOf(func(from, to State) {})
+	typeStopChan    = reflect.TypeOf((<-chan struct{})(nil))
+	typeChan        = reflect.TypeOf((chan struct{})(nil))
+)
+
+// optionTypes lists the types each Config.Option key accepts, in the order
+// values of other types are converted to them.
+var optionTypes = map[string][]reflect.Type{
+	optionKeepAlive:                {typeBool},
+	optionRunAtLoad:                {typeBool},
+	optionUserService:              {typeBool},
+	optionSessionCreate:            {typeBool},
+	optionLaunchdLabel:             {typeString},
+	optionDescriptionExtra:         {typeStringMap},
+	optionExpectedChecksum:         {typeString},
+	optionInstallPrefix:            {typeString},
+	optionExecutableByOS:           {typeStringMap},
+	optionStopTimeout:              {typeDuration},
+	optionTimeout:                  {typeDuration},
+	optionProgressFunc:             {typeProgress},
+	optionRestart:                  {typeString},
+	optionOnStateChange:            {typeStateChange},
+	optionRestartOnCleanExit:       {typeBool},
+	optionStopOnUninstall:          {typeBool},
+	optionCaptureStderr:            {typeBool},
+	optionStartInterval:            {typeInt},
+	optionStartCalendarInterval:    {typeIntMap, typeIntMaps},
+	optionPreserveSymlink:          {typeBool},
+	optionRunWait:                  {typeFunc},
+	optionReloadSignal:             {typeString},
+	optionPIDFile:                  {typeString},
+	optionOnReload:                 {typeErrorFunc},
+	optionIgnoreHUP:                {typeBool},
+	optionWatchConfig:              {typeString, typeStrings},
+	optionManageSignals:            {typeBool},
+	optionStopChannel:              {typeStopChan, typeChan},
+	optionReraiseSignal:            {typeBool},
+	optionLogIdentifierByLevel:     {typeStringMap},
+	optionSyslogAddress:            {typeString},
+	optionUnitFileMode:             {typeInt, typeFileMode},
+	optionUnitFileOwner:            {typeString},
+	optionUnitFileGroup:            {typeString},
+	optionNotifyAccess:             {typeString},
+	optionAlsoSysV:                 {typeBool},
+	optionSystemdType:              {typeString},
+	optionRemainAfterExit:          {typeBool},
+	optionBusName:                  {typeString},
+	optionStopSocketToo:            {typeBool},
+	optionSessionBus:               {typeBool},
+	optionEnableLinger:             {typeBool},
+	optionDisableLingerOnUninstall: {typeBool},
+	optionIOSchedulingClass:        {typeString},
+	optionIOSchedulingPriority:     {typeInt},
+	optionIOWeight:                 {typeInt},
+	optionSupplementaryGroups:      {typeStrings},
+	optionCGroupParent:             {typeString},
+	optionCGroupLimits:             {typeStringMap},
+	optionAppArmorProfile:          {typeString},
+	optionAppArmorProfilePath:      {typeString},
+	optionRequiresMountsFor:        {typeStrings},
+	optionConflicts:                {typeStrings},
+	optionFixupOwnership:           {typeStrings},
+	optionPassEnvironment:          {typeStrings},
+	optionUnsetEnvironment:         {typeStrings},
+	optionDelegate:                 {typeBool, typeStrings},
+	optionRestartSteps:             {typeInt},
+	optionRestartMaxDelaySec:       {typeInt},
+	optionStartLimitAction:         {typeString},
+	optionProtectProc:              {typeString},
+	optionProcSubset:               {typeString},
+	optionSecurityPreset:           {typeString},
+	optionCollectMode:              {typeString},
+	optionExecStartPost:            {typeStrings},
+	optionOnFailure:                {typeStrings},
+	optionOnFailureCommand:         {typeStrings},
+	optionPrivateNetwork:           {typeBool},
+	optionLenientDaemonReload:      {typeBool},
+	optionStrictSystemdDetection:   {typeBool},
+	optionMaskOnInstall:            {typeBool},
+	optionCPUAccounting:            {typeBool},
+	optionMemoryAccounting:         {typeBool},
+	optionTasksAccounting:          {typeBool},
+	optionIOAccounting:             {typeBool},
+	optionConditionArchitecture:    {typeString},
+	optionConditionVirtualization:  {typeString},
+	optionRuntimeDirectory:         {typeStrings},
+	optionStateDirectory:           {typeStrings},
+	optionLogsDirectory:            {typeStrings},
+	optionCacheDirectory:           {typeStrings},
+	optionPurgeData:                {typeBool},
+	optionPassword:                 {typeString},
+	optionVirtualAccount:           {typeBool},
+	optionReadinessProbe:           {typeErrorFunc},
+	optionKeepManagerConnection:    {typeBool},
+}
+
+// ConfigFromStruct builds a Config from the fields of the struct, or
+// pointer to struct, v that have a service tag. A tag names either a
+// Config field, such as Name or Arguments, or a Config.Option key:
+//
+//	type settings struct {
+//		Name        string        `service:"Name"`
+//		Restart     string        `service:"Restart,omitempty"`
+//		StopTimeout time.Duration `service:"StopTimeout"`
+//		KeepAlive   *bool         `service:"KeepAlive"`
+//	}
+//
+// Unknown names and values of the wrong type are errors, so a misspelled
+// option is reported instead of ignored. Values of named types are
+// converted to the type the option takes. A nil pointer, or a zero value
+// with omitempty, leaves the field or option unset, so its default applies.
+func ConfigFromStruct(v interface{}) (*Config, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("ConfigFromStruct needs a struct, not %T.", v)
+	}
+	c := &Config{Option: KeyValue{}}
+	cv := reflect.ValueOf(c).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		tag, ok := field.Tag.Lookup("service")
+		if !ok || tag == "-" {
+			continue
+		}
+		name, flags := tag, ""
+		if j := strings.IndexByte(tag, ','); j >= 0 {
+			name, flags = tag[:j], tag[j+1:]
+		}
+		if len(field.PkgPath) != 0 {
+			return nil, fmt.Errorf("Field %s tagged %q is not exported.", field.Name, name)
+		}
+		value := rv.Field(i)
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				continue
+			}
+			value = value.Elem()
+		}
+		if flags == "omitempty" && reflect.DeepEqual(value.Interface(), reflect.Zero(value.Type()).Interface()) {
+			continue
+		}
+
+		if f, ok := reflect.TypeOf(*c).FieldByName(name); ok && len(f.PkgPath) == 0 && f.Name != "Option" {
+			if !value.Type().ConvertibleTo(f.Type) || value.Kind() != f.Type.Kind() {
+				return nil, fmt.Errorf("Field %s is a %s, but Config.%s is a %s.", field.Name, value.Type(), name, f.Type)
+			}
+			cv.FieldByIndex(f.Index).Set(value.Convert(f.Type))
+			continue
+		}
+		types, ok := optionTypes[name]
+		if !ok {
+			return nil, fmt.Errorf("Field %s: %q is neither a Config field nor an option.", field.Name, name)
+		}
+		converted := false
+		for _, t := range types {
+			if value.Type().ConvertibleTo(t) && value.Kind() == t.Kind() {
+				c.Option[name] = value.Convert(t).Interface()
+				converted = true
+				break
+			}
+		}
+		if !converted {
+			return nil, fmt.Errorf("Field %s is a %s, but option %s takes %v.", field.Name, value.Type(), name, types)
+		}
+	}
+	return c, nil
+}